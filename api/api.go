@@ -13,15 +13,22 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
 var (
 	logger *logrus.Logger
+
+	metricsHandler = promhttp.Handler()
+	// syncStatus returns the status of the periodic reconciliation, it is provided by the caller of Init so that the
+	// api does not depend on the sync implementation
+	syncStatus func() interface{}
 )
 
-func Init() {
+func Init(syncStatusFunc func() interface{}) {
 	logger = log.Logger
+	syncStatus = syncStatusFunc
 	SetupRouter()
 }
 
@@ -29,6 +36,23 @@ func Healthz(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+// Metrics exposes the metrics in the prometheus text format
+func Metrics(c *gin.Context) {
+	metricsHandler.ServeHTTP(c.Writer, c.Request)
+}
+
+// SyncStatus reports the schedule and the result of the last periodic reconciliation
+func SyncStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, syncStatus())
+}
+
+// deadLetter keeps the event which cannot be processed, see lm.DeadLetter
+func deadLetter(reason string, data []byte, cause error) {
+	if err := lm.DeadLetter(reason, data, cause); err != nil {
+		logger.Errorf("dead-letter %v event failed, error: %v", reason, err)
+	}
+}
+
 func Notifications(c *gin.Context) {
 	data, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
@@ -37,11 +61,12 @@ func Notifications(c *gin.Context) {
 		return
 	}
 
-	logger.Debugf("received lark notification: %v", string(data))
+	logger.Debugf("received lark notification, %v bytes", len(data))
 
 	sj, err := simplejson.NewJson(data)
 	if err != nil {
 		logger.Errorf("unmarshal lark notification failed, error: %v", err.Error())
+		deadLetter(lm.DeadLetterUnparsable, data, err)
 		c.Status(http.StatusBadRequest)
 		return
 	}
@@ -61,10 +86,12 @@ func Notifications(c *gin.Context) {
 	}
 
 	eventType := sj.Get("header").Get("event_type").MustString()
+	lm.EventsReceivedTotal.WithLabelValues(lm.SourceHTTP, eventType).Inc()
 	if strings.Contains(eventType, "contact.user") {
 		userMsg := new(lm.ContactUserMsg)
 		if err = json.Unmarshal(data, userMsg); err != nil {
 			logger.Errorf("failed to parse contact user message, error: %v", err.Error())
+			deadLetter(lm.DeadLetterUnparsable, data, err)
 			return
 		}
 		lm.UserChan <- userMsg
@@ -77,6 +104,7 @@ func Notifications(c *gin.Context) {
 		depMsg := new(lm.ContactDepMsg)
 		if err = json.Unmarshal(data, depMsg); err != nil {
 			logger.Errorf("failed to parse contact department message, error: %v", err.Error())
+			deadLetter(lm.DeadLetterUnparsable, data, err)
 			return
 		}
 		lm.DepChan <- depMsg
@@ -11,5 +11,9 @@ func SetupRouter() *gin.Engine {
 
 	r.POST("/api/v1/lark/notifications", Notifications)
 
+	r.GET("/api/v1/sync/status", SyncStatus)
+
+	r.GET("/metrics", Metrics)
+
 	return r
 }
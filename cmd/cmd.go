@@ -1,33 +1,174 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"keycloak-lark-adapter/api"
 	"keycloak-lark-adapter/cmd/keycloak"
-	"keycloak-lark-adapter/cmd/lark"
 	"keycloak-lark-adapter/internal/config"
 	logger "keycloak-lark-adapter/internal/logger"
 	lm "keycloak-lark-adapter/internal/model/lark"
+	"keycloak-lark-adapter/internal/store"
+	"keycloak-lark-adapter/pkg/trace"
 	"keycloak-lark-adapter/pkg/ws"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
+
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// traceShutdownTimeout bounds the time spent exporting the pending spans when exiting
+	traceShutdownTimeout = 5 * time.Second
+	// stateFlushInterval is the interval of persisting deferred writes of the state, such as event versions
+	stateFlushInterval = 5 * time.Second
 )
 
+// commands are one-time maintenance tasks, run with the command name as the first argument
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"backfill-group-ids": func(ctx context.Context, args []string) error {
+		return keycloak.BackfillGroupIds(ctx)
+	},
+	"sync":               runSync,
+	"migrate-root-group": runMigrateRootGroup,
+}
+
 func init() {
 	// do not change the init sequence
 	config.Init()
 	logger.Init()
+	store.Init()
+	initTrace()
 
-	ws.Init()
 	keycloak.Init()
-	lark.Init()
-	api.Init()
+	api.Init(func() interface{} { return keycloak.GetSyncStatus() })
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	go handleSignals()
+	store.StartFlush(stateFlushInterval)
+
 	keycloak.ProcessContactEvent(lm.UserChan, lm.DepChan)
+	keycloak.StartSyncScheduler()
+	keycloak.StartPendingDeletions()
+	keycloak.StartPendingUsers()
 	if strings.ToLower(config.EventSource) == "http" {
 		r := api.SetupRouter()
 		r.Run(":" + config.ServerPort)
 		return
 	}
+
+	// healthz, metrics and sync status are served in websocket mode only if WEBSOCKET_SERVER_ENABLED is set
+	if config.WebsocketServerEnabled {
+		go func() {
+			r := api.SetupRouter()
+			if err := r.Run(":" + config.ServerPort); err != nil {
+				logger.Logger.Errorf("http server stopped, error: %v", err)
+			}
+		}()
+	}
+
+	// websocket connection is only needed when receiving events from the websocket adapter
+	ws.Init()
 	ws.Bot.Run()
 }
+
+func runCommand(name string, args []string) {
+	command, ok := commands[name]
+	if !ok {
+		logger.Logger.Fatalf("unknown command %v", name)
+	}
+
+	logger.Logger.Infof("running command %v", name)
+	ctx, span := trace.Start(context.Background(), "command "+name, oteltrace.SpanKindInternal)
+	err := command(ctx, args)
+	trace.End(span, err)
+	// the spans and the state of the command are persisted before exiting
+	shutdownTrace()
+	flushState()
+	if err != nil {
+		logger.Logger.Fatalf("command %v failed, error: %v", name, err)
+	}
+}
+
+// initTrace enables tracing with the exporter of TRACE_EXPORTER
+func initTrace() {
+	if err := trace.Init(config.TraceExporter, config.TraceOtlpEndpoint, config.TraceFile); err != nil {
+		logger.Logger.Fatalf("init trace exporter %v failed, error: %v", config.TraceExporter, err)
+	}
+}
+
+// shutdownTrace exports the pending spans, waiting up to traceShutdownTimeout
+func shutdownTrace() {
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+	if err := trace.Shutdown(ctx); err != nil {
+		logger.Logger.Errorf("export pending spans failed, error: %v", err)
+	}
+}
+
+// handleSignals exports the pending spans, persists the state and exits when the service is stopped
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	logger.Logger.Infof("received signal %v, exiting", sig)
+	shutdownTrace()
+	flushState()
+	os.Exit(0)
+}
+
+// flushState persists the deferred writes of the state
+func flushState() {
+	if err := store.Flush(); err != nil {
+		logger.Logger.Errorf("flush state file %v failed, error: %v", config.StateFile, err)
+	}
+}
+
+func runMigrateRootGroup(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate-root-group", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "log the groups to move without writing anything to keycloak")
+	flags.Parse(args)
+
+	return keycloak.MigrateRootGroup(ctx, *dryRun)
+}
+
+func runSync(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the plan without writing anything to keycloak")
+	output := flags.String("output", "text", "format of the printed plan, text or json")
+	force := flags.Bool("force", false, "apply the plan even if it removes more groups and users than SYNC_MAX_DELETIONS allows")
+	flags.Parse(args)
+
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unsupported output format %v, should be text or json", *output)
+	}
+
+	plan, err := keycloak.BuildPlan(ctx)
+	if err != nil {
+		return err
+	}
+	if !*dryRun {
+		return keycloak.ApplyPlan(ctx, plan, *force)
+	}
+
+	if *output == "json" {
+		buf, err := plan.JSON()
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+		return nil
+	}
+	fmt.Print(plan.Text())
+	return nil
+}
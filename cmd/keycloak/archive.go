@@ -0,0 +1,121 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	"time"
+)
+
+const (
+	depDeletePolicyDelete  = "delete"
+	depDeletePolicyArchive = "archive"
+	depDeletePolicyRefuse  = "refuse"
+
+	// attributeDeletedAt marks archived groups, they are no longer bound to their lark department
+	attributeDeletedAt = "deleted_at"
+)
+
+func isArchivedGroup(group *keycloak.GroupInfo) bool {
+	return group.GetAttribute(attributeDeletedAt) != ""
+}
+
+// removeGroupOfDep applies config.DepartmentDeletePolicy to the group of a deleted lark department.
+// The group tree is read again, so that the policy sees the members and subgroups left at this moment.
+func removeGroupOfDep(ctx context.Context, token, groupId string) error {
+	logger := log.FromContext(ctx)
+	groups, err := getGroups(ctx, token)
+	if err != nil {
+		return err
+	}
+	var group, parent *keycloak.GroupInfo
+	var f func(p *keycloak.GroupInfo, items []*keycloak.GroupInfo)
+	f = func(p *keycloak.GroupInfo, items []*keycloak.GroupInfo) {
+		for _, item := range items {
+			if item.ID == groupId {
+				group, parent = item, p
+				return
+			}
+			f(item, item.SubGroups)
+		}
+	}
+	f(nil, groups)
+	if group == nil {
+		logger.Infof("group %v does not exist in keycloak, skip delete action", groupId)
+		return nil
+	}
+
+	switch config.DepartmentDeletePolicy {
+	case depDeletePolicyArchive:
+		return archiveGroup(ctx, token, group, parent)
+	case depDeletePolicyRefuse:
+		members, err := getGroupMembers(ctx, token, group.ID)
+		if err != nil {
+			return err
+		}
+		if len(members) > 0 || len(group.SubGroups) > 0 {
+			errMsg := fmt.Sprintf("refuse to delete group %v of deleted department, %v members and %v subgroups remain",
+				group.Path, len(members), len(group.SubGroups))
+			logger.Errorf(errMsg)
+			return errors.New(errMsg)
+		}
+	}
+
+	logger.Infof("deleting group %v of deleted department", group.Path)
+	return groupDeleteEngine(ctx, token, group.ID)
+}
+
+// archiveGroup moves the group with its subgroups under config.DepartmentArchiveGroup and marks it with deleted_at,
+// so that its role mappings are kept. Its subgroups are archived along with it, see walkBoundGroups.
+func archiveGroup(ctx context.Context, token string, group, parent *keycloak.GroupInfo) error {
+	logger := log.FromContext(ctx)
+	archiveGroupId, err := ensureGroupByPath(ctx, token, config.DepartmentArchiveGroup)
+	if err != nil {
+		return err
+	}
+
+	// members of first class departments are not moved to the root group
+	if config.DepartmentArchiveMoveMembers && parent != nil && !isRootParent(parent) {
+		members, err := getGroupMembers(ctx, token, group.ID)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			logger.Infof("moving user %v from archived group %v to %v", member.Username, group.Path, parent.Path)
+			if err = userGroupAddEngine(ctx, token, member.Id, parent.ID); err != nil {
+				return err
+			}
+			if err = userGroupDeleteEngine(ctx, token, member.Id, group.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	archived := *group
+	archived.Attributes = map[string]interface{}{}
+	for key, value := range group.Attributes {
+		archived.Attributes[key] = value
+	}
+	// archived groups of departments with the same name would conflict
+	sibling, err := getSiblingGroupByName(ctx, token, archiveGroupId, group.Name)
+	if err != nil {
+		return err
+	}
+	if sibling != nil && sibling.ID != group.ID {
+		archived.Name = group.Name + "-" + group.ID[:8]
+		if err = groupNameUpdateEngine(ctx, token, &archived); err != nil {
+			return err
+		}
+	}
+
+	logger.Infof("archiving group %v under %v", group.Path, config.DepartmentArchiveGroup)
+	if err = groupParentUpdateEngine(ctx, token, group.ID, archiveGroupId); err != nil {
+		return err
+	}
+	// the group is marked only after it was moved, an interrupted archive is retried by the next reconciliation
+	archived.SetAttribute(attributeDeletedAt, time.Now().UTC().Format(time.RFC3339))
+	return groupNameUpdateEngine(ctx, token, &archived)
+}
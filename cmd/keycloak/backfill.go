@@ -0,0 +1,63 @@
+package keycloak
+
+import (
+	"context"
+	"keycloak-lark-adapter/cmd/lark"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+)
+
+// BackfillGroupIds binds the groups created before department ids were recorded to their lark departments.
+// Groups are matched by comparing their path with the full department path in lark below KEYCLOAK_ROOT_GROUP,
+// groups which are already bound are left untouched, so it is safe to run more than once.
+func BackfillGroupIds(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	token, err := getAppToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	deps, err := lark.ListDepartments(ctx)
+	if err != nil {
+		return err
+	}
+	depPaths := lark.DepartmentPaths(deps)
+	depsByPath := make(map[string]*lm.DepartmentDetail, len(deps))
+	for _, dep := range deps {
+		depsByPath[larkGroupPath(depPaths[dep.OpenDepartmentID])] = dep
+	}
+
+	groups, err := getGroups(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	var bound, skipped, unmatched int
+	walkGroups(groups, func(group *keycloak.GroupInfo) bool {
+		if group.GetAttribute(attributeLarkOpenDepartmentId) != "" {
+			skipped++
+			return true
+		}
+		dep, ok := depsByPath[group.Path]
+		if !ok {
+			logger.Debugf("cannot find department of group %v in lark, skip it", group.Path)
+			unmatched++
+			return true
+		}
+
+		logger.Infof("binding group %v to department %v", group.Path, dep.OpenDepartmentID)
+		setDepAttributes(group, dep, depPaths[dep.OpenDepartmentID])
+		if err = groupNameUpdateEngine(ctx, token, group); err != nil {
+			return false
+		}
+		bound++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("backfill group ids finished, bound: %v, already bound: %v, not in lark: %v", bound, skipped, unmatched)
+	return nil
+}
@@ -0,0 +1,146 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"keycloak-lark-adapter/cmd/lark"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"strings"
+)
+
+// depUpdate is the difference between a group and the current state of its department in lark
+type depUpdate struct {
+	group *keycloak.GroupInfo
+	dep   *lm.DepartmentDetail
+	// path is the full path of the department in lark
+	path string
+
+	rename bool
+	move   bool
+	// parentId is the keycloak id of the desired parent group, empty for first class groups
+	parentId string
+	// attributes reports whether the name or the department attributes of the group change
+	attributes bool
+	// descendants are the groups below the group whose lark path changes with it
+	descendants []*keycloak.GroupInfo
+}
+
+func (u *depUpdate) empty() bool {
+	return !u.move && !u.attributes && len(u.descendants) == 0
+}
+
+// diffDepUpdate computes the changes of the group from the department in lark: name, parent, path, order and the
+// department metadata. groups is
+// the group tree the group was found in.
+func diffDepUpdate(ctx context.Context, token string, groups []*keycloak.GroupInfo, group *keycloak.GroupInfo, depObj *lm.DepObject) (*depUpdate, error) {
+	dep := depDetailFromObject(depObj)
+	// 部门事件不包含成员数量，从飞书获取
+	current, err := lark.GetDepartment(ctx, dep.OpenDepartmentID)
+	if err != nil {
+		return nil, err
+	}
+	dep.MemberCount = current.MemberCount
+	path, err := larkDepPath(ctx, dep)
+	if err != nil {
+		return nil, err
+	}
+	// 通过飞书中上级部门的id，获取上级部门在Keycloak中的id。
+	// 飞书中上级部门parent_department_id为"0"时，group应在根group下，未配置根group时parentId为空，group为一级group。
+	parentId, err := ensureGroupForDep(ctx, token, dep.ParentDepartmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	update := &depUpdate{group: group, dep: dep, path: path, parentId: parentId}
+	update.rename = group.Name != dep.Name
+	actualParentId := ""
+	if parent := findParentGroup(groups, group.ID); parent != nil {
+		actualParentId = parent.ID
+	}
+	update.move = actualParentId != parentId
+	update.attributes = update.rename || len(depAttributeDiffs(nil, group, genGroup4Create(dep, path))) > 0
+
+	// 子部门在飞书中的路径随之变化，group名称与部门名称一致，由Keycloak中的相对路径得出
+	walkBoundGroups(group.SubGroups, func(item *keycloak.GroupInfo) bool {
+		if item.GetAttribute(attributeLarkOpenDepartmentId) == "" {
+			return true
+		}
+		if item.GetAttribute(attributeLarkPath) != descendantPath(group, item, path) {
+			update.descendants = append(update.descendants, item)
+		}
+		return true
+	})
+	return update, nil
+}
+
+// applyDepUpdate applies the update in a safe order: the destination is checked for a group with the same name before
+// anything is changed, the group is moved and renamed in one request, then its attributes and the paths of its
+// descendants are updated
+func applyDepUpdate(ctx context.Context, token string, update *depUpdate) error {
+	logger := log.FromContext(ctx)
+	group, dep := update.group, update.dep
+	if update.empty() {
+		logger.Debugf("group %v is up to date with department %v", group.Path, dep.OpenDepartmentID)
+		return nil
+	}
+
+	if update.rename || update.move {
+		sibling, err := getSiblingGroupByName(ctx, token, update.parentId, dep.Name)
+		if err != nil {
+			return err
+		}
+		if sibling != nil && sibling.ID != group.ID {
+			errMsg := fmt.Sprintf("cannot update group %v of department %v to %v, group %v already exists", group.Path, dep.OpenDepartmentID, dep.Name, sibling.Path)
+			logger.Errorf(errMsg)
+			return errors.New(errMsg)
+		}
+	}
+
+	if update.move {
+		logger.Infof("moving group %v of department %v to parent group %v as %v", group.Path, dep.OpenDepartmentID, update.parentId, dep.Name)
+		if err := groupMoveEngine(ctx, token, group.ID, dep.Name, update.parentId); err != nil {
+			return err
+		}
+	}
+
+	if update.attributes {
+		logger.Infof("updating group %v of department %v, name: %v, path: %v", group.Path, dep.OpenDepartmentID, dep.Name, update.path)
+		group.Name = dep.Name
+		setDepAttributes(group, dep, update.path)
+		if err := groupNameUpdateEngine(ctx, token, group); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range update.descendants {
+		path := descendantPath(group, item, update.path)
+		logger.Infof("updating lark path of group %v from %v to %v", item.Path, item.GetAttribute(attributeLarkPath), path)
+		item.SetAttribute(attributeLarkPath, path)
+		if err := groupNameUpdateEngine(ctx, token, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// descendantPath returns the lark path of a group below the group, given the lark path of the group
+func descendantPath(group, descendant *keycloak.GroupInfo, path string) string {
+	return path + strings.TrimPrefix(descendant.Path, group.Path)
+}
+
+// findParentGroup returns the parent of the group in the tree, nil for first class groups
+func findParentGroup(groups []*keycloak.GroupInfo, groupId string) (parent *keycloak.GroupInfo) {
+	walkGroups(groups, func(item *keycloak.GroupInfo) bool {
+		for _, sub := range item.SubGroups {
+			if sub.ID == groupId {
+				parent = item
+				return false
+			}
+		}
+		return true
+	})
+	return parent
+}
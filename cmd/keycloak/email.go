@@ -0,0 +1,173 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"keycloak-lark-adapter/cmd/lark"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"keycloak-lark-adapter/internal/store"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	bucketPendingUsers   = "pending_users"
+	pendingUsersInterval = 10 * time.Minute
+
+	// attributeLarkEmailSource marks users whose keycloak email is not the email of the lark user: enterprise for
+	// the enterprise email, template for the address built from EMAIL_TEMPLATE
+	attributeLarkEmailSource = "lark_email_source"
+	emailSourceEnterprise    = "enterprise"
+	emailSourceTemplate      = "template"
+)
+
+// pendingUser is a lark user which can be created neither with an email nor with a username, persisted in the
+// state store and retried until lark assigns an email
+type pendingUser struct {
+	OpenId string    `json:"open_id"`
+	Name   string    `json:"name"`
+	Since  time.Time `json:"since"`
+}
+
+// emailTemplate renders EMAIL_TEMPLATE, it reuses the template handling of the attribute mappings
+var emailTemplate *AttributeMapping
+
+func initEmailTemplate() {
+	if config.EmailTemplate == "" {
+		return
+	}
+	tmpl, err := template.New("email").Parse(config.EmailTemplate)
+	if err != nil {
+		logger.Fatalf("invalid param EMAIL_TEMPLATE %v, error: %v", config.EmailTemplate, err)
+	}
+	emailTemplate = &AttributeMapping{Template: config.EmailTemplate, Target: "email", tmpl: tmpl}
+}
+
+// fillEmail sets the email of a lark user without email to its enterprise email, or to the address built from
+// EMAIL_TEMPLATE. The email stays empty if neither is available.
+func fillEmail(userObj *lm.UserObject) {
+	if userObj == nil || userObj.Email != "" {
+		return
+	}
+	if userObj.EnterpriseEmail != "" {
+		userObj.Email = userObj.EnterpriseEmail
+		return
+	}
+	if emailTemplate == nil {
+		return
+	}
+	email := strings.TrimSpace(emailTemplate.value(larkUserFields(userObj)))
+	// the template renders missing fields as empty strings, e.g. "@example.com"
+	if idx := strings.LastIndex(email, "@"); idx > 0 && idx < len(email)-1 && !strings.ContainsAny(email, " \t") {
+		userObj.Email = strings.ToLower(email)
+	}
+}
+
+// emailSource returns the source of the email fillEmail set for the lark user, "" if it is the email of the user in
+// lark. An email equal to the fallback is reported as the fallback, replacing it in place changes nothing.
+func emailSource(userObj *lm.UserObject) string {
+	if userObj == nil || userObj.Email == "" {
+		return ""
+	}
+	if userObj.EnterpriseEmail != "" && strings.EqualFold(userObj.Email, userObj.EnterpriseEmail) {
+		return emailSourceEnterprise
+	}
+	if emailTemplate != nil && strings.EqualFold(userObj.Email, strings.TrimSpace(emailTemplate.value(larkUserFields(userObj)))) {
+		return emailSourceTemplate
+	}
+	return ""
+}
+
+// setEmailSource records the source of the email in the attributes, it is removed once the user has its lark email
+func setEmailSource(attrs map[string]interface{}, userObj *lm.UserObject) {
+	if source := emailSource(userObj); source != "" {
+		attrs[attributeLarkEmailSource] = source
+	} else {
+		delete(attrs, attributeLarkEmailSource)
+	}
+}
+
+// parkUser records the lark user as pending, it is created once lark assigns an email or a username field
+func parkUser(userObj *lm.UserObject) error {
+	if ok, err := store.Get(bucketPendingUsers, userObj.OpenID, new(pendingUser)); err != nil || ok {
+		return err
+	}
+	logger.Warnf("user %v has neither email nor username in lark, it is pending until an email is assigned", describeUser(userObj))
+	return store.Put(bucketPendingUsers, userObj.OpenID, &pendingUser{
+		OpenId: userObj.OpenID,
+		Name:   userObj.Name,
+		Since:  time.Now(),
+	})
+}
+
+func unparkUser(openId string) error {
+	return store.Delete(bucketPendingUsers, openId)
+}
+
+// StartPendingUsers retries the pending users every 10 minutes
+func StartPendingUsers() {
+	go func() {
+		ctx := context.Background()
+		for {
+			processPendingUsers(ctx)
+			time.Sleep(pendingUsersInterval)
+		}
+	}()
+}
+
+func processPendingUsers(ctx context.Context) {
+	logger := log.FromContext(ctx)
+	pending := store.List(bucketPendingUsers)
+	if len(pending) == 0 {
+		return
+	}
+
+	token, err := getAppToken(ctx)
+	if err != nil {
+		return
+	}
+	for key, raw := range pending {
+		item := new(pendingUser)
+		if err = json.Unmarshal(raw, item); err != nil {
+			logger.Errorf("unmarshal pending user %v failed, error: %v", key, err)
+			continue
+		}
+
+		userObj, err := lark.GetUser(ctx, item.OpenId)
+		if errors.Is(err, lark.ErrUserNotFound) {
+			logger.Infof("pending user %v was deleted in lark, forget it", item.OpenId)
+			if err = unparkUser(item.OpenId); err != nil {
+				logger.Errorf("remove pending user %v failed, error: %v", item.OpenId, err)
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		fillEmail(userObj)
+		if baseUsername(userObj) == "" {
+			continue
+		}
+
+		logger.Infof("pending user %v can be created now, retrying", describeUser(userObj))
+		inScope, err := larkUserInScope(ctx, userObj)
+		if err != nil {
+			continue
+		}
+		if inScope {
+			// an empty old object updates every field, as for a user missing in keycloak
+			err = userUpdate(ctx, token, userObj, &lm.UserObject{})
+		}
+		if err != nil {
+			logger.Errorf("retry pending user %v failed, error: %v", describeUser(userObj), err)
+			continue
+		}
+		if err = unparkUser(item.OpenId); err != nil {
+			logger.Errorf("remove pending user %v failed, error: %v", describeUser(userObj), err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package keycloak
+
+import (
+	"context"
+	log "keycloak-lark-adapter/internal/logger"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"keycloak-lark-adapter/pkg/trace"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// fields of the log lines emitted while processing an event
+const (
+	fieldEventId      = "event_id"
+	fieldEventType    = "event_type"
+	fieldLarkOpenId   = "lark_open_id"
+	fieldDepartmentId = "department_id"
+	fieldKeycloakId   = "keycloak_id"
+	fieldTraceId      = "trace_id"
+)
+
+// startEvent starts the span of the event and returns a copy of ctx carrying the span and the event fields, the API
+// calls and log lines made with it belong to the event. The returned function is called with the result of processing
+// the event. idField is fieldLarkOpenId or fieldDepartmentId.
+func startEvent(ctx context.Context, header *lm.ContactMsgHeader, idField, id string) (context.Context, func(err error)) {
+	ctx, span := trace.Start(ctx, "process "+header.EventType, oteltrace.SpanKindConsumer)
+	span.SetAttributes(
+		attribute.String(fieldEventId, header.EventID),
+		attribute.String(fieldEventType, header.EventType),
+		attribute.String(idField, id),
+	)
+
+	fields := logrus.Fields{fieldEventId: header.EventID, fieldEventType: header.EventType, idField: id}
+	if traceId := trace.TraceID(ctx); traceId != "" {
+		fields[fieldTraceId] = traceId
+	}
+	return log.WithFields(ctx, fields), func(err error) {
+		trace.End(span, err)
+	}
+}
+
+// withKeycloakId returns a copy of ctx whose log lines carry the id of the keycloak user or group of the event
+func withKeycloakId(ctx context.Context, id string) context.Context {
+	return log.WithFields(ctx, logrus.Fields{fieldKeycloakId: id})
+}
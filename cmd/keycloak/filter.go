@@ -0,0 +1,174 @@
+package keycloak
+
+import (
+	"context"
+	"keycloak-lark-adapter/cmd/lark"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"strings"
+)
+
+const outOfScopeOffboard = "offboard"
+
+// depLookup returns the lark department by open department id, nil if it is not visible
+type depLookup func(depId string) (*lm.DepartmentDetail, error)
+
+func hasDepFilters() bool {
+	return len(config.DepartmentInclude) > 0 || len(config.DepartmentExclude) > 0
+}
+
+// depInScope reports whether the department is in scope of DEPARTMENT_INCLUDE and DEPARTMENT_EXCLUDE. The filters
+// cover whole subtrees, so the department and its ancestors are looked up to the root. The root department is in
+// scope unless DEPARTMENT_INCLUDE is set.
+func depInScope(depId string, lookup depLookup) (bool, error) {
+	if !hasDepFilters() {
+		return true, nil
+	}
+
+	var chain []*lm.DepartmentDetail
+	seen := map[string]bool{}
+	for id := depId; id != "" && id != lark.RootDepartmentId && !seen[id]; {
+		seen[id] = true
+		dep, err := lookup(id)
+		if err != nil {
+			return false, err
+		}
+		if dep == nil {
+			break
+		}
+		chain = append(chain, dep)
+		id = dep.ParentDepartmentID
+	}
+	path := ""
+	for _, dep := range chain {
+		path = "/" + dep.Name + path
+	}
+
+	if matchDeps(config.DepartmentExclude, chain, path) {
+		return false, nil
+	}
+	return len(config.DepartmentInclude) == 0 || matchDeps(config.DepartmentInclude, chain, path), nil
+}
+
+// matchDeps reports whether an item, a department id or path, matches the department or one of its ancestors.
+// chain is the department followed by its ancestors, path is the full path of the department.
+func matchDeps(items []string, chain []*lm.DepartmentDetail, path string) bool {
+	for _, item := range items {
+		if strings.HasPrefix(item, "/") {
+			prefix := "/" + strings.Trim(item, "/")
+			if path != "" && (path == prefix || strings.HasPrefix(path, prefix+"/")) {
+				return true
+			}
+			continue
+		}
+		for _, dep := range chain {
+			if dep.OpenDepartmentID == item || dep.DepartmentID == item {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// userInScope reports whether the lark user is in scope of the user filters and has at least one department in
+// scope, depFilter reports whether a department is in scope
+func userInScope(userObj *lm.UserObject, depFilter func(depId string) (bool, error)) (bool, error) {
+	if matchUserIds(config.UserExcludeIds, userObj) {
+		return false, nil
+	}
+	if len(config.UserIncludeIds) > 0 && !matchUserIds(config.UserIncludeIds, userObj) {
+		return false, nil
+	}
+	if containsInt(config.UserExcludeEmployeeTypes, userObj.EmployeeType) {
+		return false, nil
+	}
+	if len(config.UserIncludeEmployeeTypes) > 0 && !containsInt(config.UserIncludeEmployeeTypes, userObj.EmployeeType) {
+		return false, nil
+	}
+
+	domain := ""
+	if idx := strings.LastIndex(userObj.Email, "@"); idx >= 0 {
+		domain = strings.ToLower(userObj.Email[idx+1:])
+	}
+	if domain != "" && containsFold(config.UserExcludeEmailDomains, domain) {
+		return false, nil
+	}
+	if len(config.UserIncludeEmailDomains) > 0 && !containsFold(config.UserIncludeEmailDomains, domain) {
+		return false, nil
+	}
+
+	if !hasDepFilters() {
+		return true, nil
+	}
+	depIds := getUserDepIds(userObj)
+	if len(depIds) == 0 {
+		// users directly below the root department
+		return len(config.DepartmentInclude) == 0, nil
+	}
+	for _, depId := range depIds {
+		ok, err := depFilter(depId)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func matchUserIds(ids []string, userObj *lm.UserObject) bool {
+	for _, id := range ids {
+		if id == userObj.OpenID || id == userObj.UnionID || id == userObj.UserID ||
+			(userObj.EmployeeNo != "" && id == userObj.EmployeeNo) || strings.EqualFold(id, userObj.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, value int) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// larkDepLookup looks up departments in lark, known departments such as the one of the event are used as is.
+// Departments are cached, so a lookup should only be used for a single event.
+func larkDepLookup(ctx context.Context, known ...*lm.DepartmentDetail) depLookup {
+	cache := map[string]*lm.DepartmentDetail{}
+	for _, dep := range known {
+		cache[dep.OpenDepartmentID] = dep
+	}
+	return func(depId string) (*lm.DepartmentDetail, error) {
+		if dep, ok := cache[depId]; ok {
+			return dep, nil
+		}
+		dep, err := lark.GetDepartment(ctx, depId)
+		if err != nil {
+			return nil, err
+		}
+		cache[depId] = dep
+		return dep, nil
+	}
+}
+
+// larkUserInScope is userInScope with the departments looked up in lark
+func larkUserInScope(ctx context.Context, userObj *lm.UserObject) (bool, error) {
+	lookup := larkDepLookup(ctx)
+	return userInScope(userObj, func(depId string) (bool, error) {
+		return depInScope(depId, lookup)
+	})
+}
+
+// outOfScopeUser applies OUT_OF_SCOPE_ACTION to the keycloak user of the lark user
+func outOfScopeUser(ctx context.Context, token string, userObj *lm.UserObject) error {
+	logger := log.FromContext(ctx)
+	if config.OutOfScopeAction != outOfScopeOffboard {
+		logger.Infof("user %v is out of scope, skip it", describeUser(userObj))
+		return nil
+	}
+	logger.Infof("user %v is out of scope, offboarding it", describeUser(userObj))
+	return userOffboard(ctx, token, userObj, offboardReasonOutOfScope)
+}
@@ -0,0 +1,136 @@
+package keycloak
+
+import (
+	"keycloak-lark-adapter/internal/config"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"testing"
+)
+
+// testDepLookup looks up the departments by open department id
+func testDepLookup(deps ...*lm.DepartmentDetail) depLookup {
+	byId := map[string]*lm.DepartmentDetail{}
+	for _, dep := range deps {
+		byId[dep.OpenDepartmentID] = dep
+	}
+	return func(depId string) (*lm.DepartmentDetail, error) {
+		return byId[depId], nil
+	}
+}
+
+func TestDepInScope(t *testing.T) {
+	dev := testDep("od-dev", "Dev", "0")
+	qa := testDep("od-qa", "QA", "od-dev")
+	qa.DepartmentID = "d-qa"
+	ops := testDep("od-ops", "Ops", "0")
+	lookup := testDepLookup(dev, qa, ops)
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		depId   string
+		want    bool
+	}{
+		{name: "no filters", depId: "od-qa", want: true},
+		{name: "included by path", include: []string{"/Dev"}, depId: "od-dev", want: true},
+		{name: "included by the path of the parent", include: []string{"/Dev/"}, depId: "od-qa", want: true},
+		{name: "included by the id of the parent", include: []string{"od-dev"}, depId: "od-qa", want: true},
+		{name: "included by department id", include: []string{"d-qa"}, depId: "od-qa", want: true},
+		{name: "not included", include: []string{"/Dev"}, depId: "od-ops"},
+		{name: "path prefix is not a parent", include: []string{"/De"}, depId: "od-dev"},
+		{name: "excluded", exclude: []string{"/Ops"}, depId: "od-ops"},
+		{name: "excluded by the parent", exclude: []string{"od-dev"}, depId: "od-qa"},
+		{name: "not excluded", exclude: []string{"/Dev/QA"}, depId: "od-dev", want: true},
+		{name: "exclude takes precedence over include", include: []string{"/Dev"}, exclude: []string{"/Dev/QA"}, depId: "od-qa"},
+		{name: "include of a child does not include the parent", include: []string{"/Dev/QA"}, depId: "od-dev"},
+		{name: "root without include", exclude: []string{"/Ops"}, depId: "0", want: true},
+		{name: "root with include", include: []string{"/Dev"}, depId: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.DepartmentInclude, config.DepartmentExclude = tt.include, tt.exclude
+			defer func() { config.DepartmentInclude, config.DepartmentExclude = nil, nil }()
+			got, err := depInScope(tt.depId, lookup)
+			if err != nil {
+				t.Fatalf("depInScope() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("depInScope() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserInScope(t *testing.T) {
+	userObj := &lm.UserObject{
+		OpenID:        "ou-alice",
+		EmployeeNo:    "E001",
+		Email:         "alice@Example.com",
+		EmployeeType:  1,
+		DepartmentIDs: []string{"od-ops", "od-dev"},
+	}
+	inDev := func(depId string) (bool, error) { return depId == "od-dev", nil }
+
+	tests := []struct {
+		name  string
+		setup func()
+		want  bool
+	}{
+		{name: "no filters", setup: func() {}, want: true},
+		{name: "included by employee number", setup: func() { config.UserIncludeIds = []string{"E001"} }, want: true},
+		{name: "not included by id", setup: func() { config.UserIncludeIds = []string{"ou-bob"} }},
+		{
+			name: "excluded id takes precedence",
+			setup: func() {
+				config.UserIncludeIds = []string{"ou-alice"}
+				config.UserExcludeIds = []string{"alice@example.com"}
+			},
+		},
+		{name: "excluded employee type", setup: func() { config.UserExcludeEmployeeTypes = []int{1} }},
+		{name: "not included employee type", setup: func() { config.UserIncludeEmployeeTypes = []int{2} }},
+		{name: "included email domain ignoring case", setup: func() { config.UserIncludeEmailDomains = []string{"example.com"} }, want: true},
+		{
+			name: "excluded email domain takes precedence",
+			setup: func() {
+				config.UserIncludeEmailDomains = []string{"example.com"}
+				config.UserExcludeEmailDomains = []string{"EXAMPLE.com"}
+			},
+		},
+		{name: "one department in scope", setup: func() { config.DepartmentInclude = []string{"od-dev"} }, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			defer func() {
+				config.UserIncludeIds, config.UserExcludeIds = nil, nil
+				config.UserIncludeEmployeeTypes, config.UserExcludeEmployeeTypes = nil, nil
+				config.UserIncludeEmailDomains, config.UserExcludeEmailDomains = nil, nil
+				config.DepartmentInclude = nil
+			}()
+			got, err := userInScope(userObj, inDev)
+			if err != nil {
+				t.Fatalf("userInScope() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("userInScope() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("no department in scope", func(t *testing.T) {
+		config.DepartmentInclude = []string{"od-qa"}
+		defer func() { config.DepartmentInclude = nil }()
+		got, _ := userInScope(userObj, func(string) (bool, error) { return false, nil })
+		if got {
+			t.Errorf("userInScope() = true, want false")
+		}
+	})
+	t.Run("below the root department with include", func(t *testing.T) {
+		config.DepartmentInclude = []string{"od-dev"}
+		defer func() { config.DepartmentInclude = nil }()
+		got, _ := userInScope(&lm.UserObject{OpenID: "ou-root"}, inDev)
+		if got {
+			t.Errorf("userInScope() = true, want false")
+		}
+	})
+}
@@ -1,41 +1,80 @@
 package keycloak
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"keycloak-lark-adapter/cmd/lark"
 	"keycloak-lark-adapter/internal/config"
 	"keycloak-lark-adapter/internal/http"
+	log "keycloak-lark-adapter/internal/logger"
 	"keycloak-lark-adapter/internal/model/keycloak"
 	lm "keycloak-lark-adapter/internal/model/lark"
 	"keycloak-lark-adapter/pkg/utils"
 	http2 "net/http"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-func processDepMsgWithType(msg *lm.ContactDepMsg) error {
-	token, err := getAppToken()
+// groupCreateLock serializes looking up and creating the groups of departments: events processed in parallel would
+// otherwise both miss the group of the same department, or of a shared ancestor, and create it twice
+var groupCreateLock sync.Mutex
+
+func processDepMsgWithType(ctx context.Context, msg *lm.ContactDepMsg) error {
+	logger := log.FromContext(ctx)
+	token, err := getAppToken(ctx)
 	if err != nil {
 		return err
 	}
 
 	eventType := msg.Header.EventType
+	// 延迟重发的旧事件可能回滚部门名称、层级，早于已处理事件的事件按STALE_EVENT_POLICY处理
+	if isStaleEvent(entityDepartment, msg.Event.Object.OpenDepartmentID, msg.Header) {
+		return staleDepEvent(ctx, token, msg)
+	}
+
 	switch eventType {
 	case eventTypeDepartmentCreate:
-		err = groupCreate(token, msg)
+		inScope, err := depInScope(msg.Event.Object.OpenDepartmentID, larkDepLookup(ctx, depDetailFromObject(msg.Event.Object)))
+		if err != nil {
+			return err
+		}
+		if !inScope {
+			logger.Infof("department %v is out of scope, skip create action", msg.Event.Object.OpenDepartmentID)
+			break
+		}
+		err = groupCreate(ctx, token, msg)
 		if err != nil {
 			logger.Errorf("process department create msg failed, error: %v", err.Error())
 			return err
 		}
 	case eventTypeDepartmentUpdate:
-		err = groupUpdate(token, msg)
+		inScope, err := depInScope(msg.Event.Object.OpenDepartmentID, larkDepLookup(ctx, depDetailFromObject(msg.Event.Object)))
+		if err != nil {
+			return err
+		}
+		if !inScope {
+			// 部门移出同步范围后不再同步，对应的group保持原样
+			logger.Infof("department %v is out of scope, skip update action", msg.Event.Object.OpenDepartmentID)
+			break
+		}
+		err = groupUpdate(ctx, token, msg)
 		if err != nil {
 			logger.Errorf("process department update msg failed, error: %v", err.Error())
 			return err
 		}
 	case eventTypeDepartmentDelete:
-		err = groupDelete(token, msg)
+		inScope, err := depInScope(msg.Event.Object.OpenDepartmentID, larkDepLookup(ctx, depDetailFromObject(msg.Event.Object)))
+		if err != nil {
+			return err
+		}
+		if !inScope {
+			logger.Infof("department %v is out of scope, skip delete action", msg.Event.Object.OpenDepartmentID)
+			break
+		}
+		err = groupDelete(ctx, token, msg)
 		if err != nil {
 			logger.Errorf("process department delete msg failed, error: %v", err.Error())
 			return err
@@ -47,116 +86,312 @@ func processDepMsgWithType(msg *lm.ContactDepMsg) error {
 		return errors.New(errMsg)
 	}
 
-	return nil
+	if eventType == eventTypeDepartmentDelete {
+		return forgetEventVersion(entityDepartment, msg.Event.Object.OpenDepartmentID)
+	}
+	return recordEventVersion(entityDepartment, msg.Event.Object.OpenDepartmentID, msg.Header)
 }
 
-func groupCreate(token string, msg *lm.ContactDepMsg) (err error) {
-	groupObj := msg.Event.Object
+func groupCreate(ctx context.Context, token string, msg *lm.ContactDepMsg) (err error) {
+	logger := log.FromContext(ctx)
+	depObj := msg.Event.Object
+	groupCreateLock.Lock()
+	defer groupCreateLock.Unlock()
 
-	lkParentDepId := groupObj.ParentDepartmentID
-	if lkParentDepId == lark.RootDepartmentId {
-		err = groupCreateEngine(token, groupObj.Name)
-		if err != nil {
-			return err
-		}
+	group, err := getGroupByDepId(ctx, token, depObj.OpenDepartmentID)
+	if err != nil {
+		return err
+	}
+	if group != nil {
+		logger.Infof("group %v of department %v already exists in keycloak, skip create action", group.Path, depObj.OpenDepartmentID)
+		return nil
+	}
+
+	// the parent department may not be synchronized yet if events arrive out of order
+	parentGroupId, err := ensureGroupForDepLocked(ctx, token, depObj.ParentDepartmentID)
+	if err != nil {
+		return err
+	}
+
+	dep := depDetailFromObject(depObj)
+	// 部门事件不包含成员数量，从飞书获取
+	current, err := lark.GetDepartment(ctx, dep.OpenDepartmentID)
+	if err != nil {
+		return err
+	}
+	dep.MemberCount = current.MemberCount
+	path, err := larkDepPath(ctx, dep)
+	if err != nil {
+		return err
+	}
+	groupId, err := createGroupForDep(ctx, token, dep, path, parentGroupId)
+	if err != nil {
+		return err
+	}
+	ctx = withKeycloakId(ctx, groupId)
+	return grantLeaderRole(ctx, token, depObj.LeaderUserID)
+}
+
+// ensureGroupForDep returns the keycloak group id of the lark department, the group and its missing ancestors
+// are created from the department info in lark if they do not exist. The root department maps to the root group,
+// see rootGroupId.
+func ensureGroupForDep(ctx context.Context, token, depId string) (groupId string, err error) {
+	groupCreateLock.Lock()
+	defer groupCreateLock.Unlock()
+	return ensureGroupForDepLocked(ctx, token, depId)
+}
+
+// ensureGroupForDepLocked is ensureGroupForDep for callers holding groupCreateLock
+func ensureGroupForDepLocked(ctx context.Context, token, depId string) (groupId string, err error) {
+	logger := log.FromContext(ctx)
+	if depId == "" || depId == lark.RootDepartmentId {
+		return rootGroupId(ctx, token)
+	}
+	// 超出同步范围的部门没有group，其子部门作为一级部门
+	inScope, err := depInScope(depId, larkDepLookup(ctx))
+	if err != nil {
+		return "", err
+	}
+	if !inScope {
+		return rootGroupId(ctx, token)
+	}
+
+	group, err := getGroupByDepId(ctx, token, depId)
+	if err != nil {
+		return "", err
+	}
+	if group != nil {
+		return group.ID, nil
+	}
+
+	logger.Infof("cannot find group of department %v in keycloak, trying to create", depId)
+	dep, err := lark.GetDepartment(ctx, depId)
+	if err != nil {
+		return "", err
+	}
+	parentGroupId, err := ensureGroupForDepLocked(ctx, token, dep.ParentDepartmentID)
+	if err != nil {
+		return "", err
+	}
+	path, err := larkDepPath(ctx, dep)
+	if err != nil {
+		return "", err
+	}
+	return createGroupForDep(ctx, token, dep, path, parentGroupId)
+}
+
+// createGroupForDep creates the group of the lark department below parentGroupId, or as a first class group if
+// parentGroupId is empty. A group with the same name which is not bound to any department is adopted. path is the
+// full path of the department in lark.
+func createGroupForDep(ctx context.Context, token string, dep *lm.DepartmentDetail, path, parentGroupId string) (groupId string, err error) {
+	logger := log.FromContext(ctx)
+	group := genGroup4Create(dep, path)
+	leader, err := leaderValue(ctx, token, dep.LeaderUserID)
+	if err != nil {
+		return "", err
+	}
+	setGroupLeader(group, dep.LeaderUserID, leader)
+
+	var created bool
+	if parentGroupId == "" {
+		groupId, created, err = groupCreateEngine(ctx, token, group)
 	} else {
-		fullDepNameInLark, err := lark.GetFullDepName(lkParentDepId)
-		if err != nil {
-			return err
-		}
+		groupId, created, err = subGroupCreateEngine(ctx, token, group, parentGroupId)
+	}
+	if err != nil {
+		return "", err
+	}
+	if created {
+		return groupId, nil
+	}
 
-		// get group id in keycloak by full department name
-		kcGroupId, err := getGroupIdByName(token, fullDepNameInLark)
-		if err != nil {
-			return err
-		}
-		err = subGroupCreateEngine(token, groupObj.Name, kcGroupId)
-		if err != nil {
-			return err
-		}
+	// keycloak responds conflict if a sibling group already has the same name
+	sibling, err := getSiblingGroupByName(ctx, token, parentGroupId, group.Name)
+	if err != nil {
+		return "", err
+	}
+	if sibling == nil {
+		return "", fmt.Errorf("create group %v conflicted, but cannot find it in keycloak", group.Name)
+	}
+	if boundDepId := sibling.GetAttribute(attributeLarkOpenDepartmentId); boundDepId != "" && boundDepId != dep.OpenDepartmentID {
+		errMsg := fmt.Sprintf("group %v is already bound to department %v, cannot bind it to department %v", sibling.Path, boundDepId, dep.OpenDepartmentID)
+		logger.Errorf(errMsg)
+		return "", errors.New(errMsg)
 	}
 
-	return nil
+	logger.Infof("group %v already exists, binding it to department %v", sibling.Path, dep.OpenDepartmentID)
+	setDepAttributes(sibling, dep, path)
+	setGroupLeader(sibling, dep.LeaderUserID, leader)
+	if err = groupNameUpdateEngine(ctx, token, sibling); err != nil {
+		return "", err
+	}
+	return sibling.ID, nil
 }
 
-func subGroupCreateEngine(token, groupName, parentGroupId string) error {
-	logger.Debugf("creating sub group %v, parent group id: %v", groupName, parentGroupId)
+func genGroup4Create(dep *lm.DepartmentDetail, path string) *keycloak.GroupInfo {
+	group := &keycloak.GroupInfo{Name: dep.Name}
+	setDepAttributes(group, dep, path)
+	return group
+}
 
-	m := make(map[string]string)
-	m["name"] = groupName
+// setDepAttributes binds the group to the lark department and marks it as managed by the adapter. path is the full
+// path of the department in lark, it is not recorded if empty.
+func setDepAttributes(group *keycloak.GroupInfo, dep *lm.DepartmentDetail, path string) {
+	group.SetAttribute(attributeManagedBy, managedByAdapter)
+	group.SetAttribute(attributeLarkOpenDepartmentId, dep.OpenDepartmentID)
+	if dep.DepartmentID != "" {
+		group.SetAttribute(attributeLarkDepartmentId, dep.DepartmentID)
+	}
+	if path != "" {
+		group.SetAttribute(attributeLarkPath, path)
+	}
+	if dep.Order != "" {
+		group.SetAttribute(attributeLarkOrder, dep.Order)
+	}
+	setDepMetadata(group, dep)
+}
+
+// setDepMetadata mirrors the group chat, member count and units of the lark department, the attributes of the
+// fields the department does not have are removed
+func setDepMetadata(group *keycloak.GroupInfo, dep *lm.DepartmentDetail) {
+	delete(group.Attributes, attributeLarkChatId)
+	delete(group.Attributes, attributeLarkUnitIds)
+	if dep.ChatID != "" {
+		group.SetAttribute(attributeLarkChatId, dep.ChatID)
+	}
+	if len(dep.UnitIDs) > 0 {
+		group.Attributes[attributeLarkUnitIds] = dep.UnitIDs
+	}
+	group.SetAttribute(attributeLarkMemberCount, strconv.Itoa(dep.MemberCount))
+}
+
+// depAttributeDiffs records the differences between the attributes of the group and the desired ones built by
+// setDepAttributes, extra are attributes which are removed when the department does not have them
+func depAttributeDiffs(diffs []*FieldDiff, group, desired *keycloak.GroupInfo, extra ...string) []*FieldDiff {
+	keys := withKeys(sortedAttributeKeys(desired.Attributes), append(extra, attributeLarkChatId, attributeLarkUnitIds)...)
+	for _, key := range keys {
+		old := strings.Join(keycloak.AttributeValues(group.Attributes, key), ",")
+		diffs = diffField(diffs, "attributes."+key, old, strings.Join(keycloak.AttributeValues(desired.Attributes, key), ","))
+	}
+	return diffs
+}
+
+// larkDepPath returns the full path of the department in lark, in the format of lark.GetFullDepName
+func larkDepPath(ctx context.Context, dep *lm.DepartmentDetail) (string, error) {
+	if dep.ParentDepartmentID == "" || dep.ParentDepartmentID == lark.RootDepartmentId {
+		return "/" + dep.Name, nil
+	}
+	parentPath, err := lark.GetFullDepName(ctx, dep.ParentDepartmentID)
+	if err != nil {
+		return "", err
+	}
+	return parentPath + "/" + dep.Name, nil
+}
+
+func depDetailFromObject(depObj *lm.DepObject) *lm.DepartmentDetail {
+	return &lm.DepartmentDetail{
+		OpenDepartmentID:   depObj.OpenDepartmentID,
+		DepartmentID:       depObj.DepartmentID,
+		Name:               depObj.Name,
+		ParentDepartmentID: depObj.ParentDepartmentID,
+		LeaderUserID:       depObj.LeaderUserID,
+		Order:              strconv.Itoa(depObj.Order),
+		ChatID:             depObj.ChatID,
+		UnitIDs:            depObj.UnitIDs,
+	}
+}
+
+func subGroupCreateEngine(ctx context.Context, token string, group *keycloak.GroupInfo, parentGroupId string) (groupId string, created bool, err error) {
+	logger := log.FromContext(ctx)
+	logger.Debugf("creating sub group %v, parent group id: %v", group.Name, parentGroupId)
 
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
-		SetBody(m).
-		Post(config.Host + "/auth/admin/realms/" + config.Realm + "/groups/" + parentGroupId + "/children")
+		SetBody(group).
+		SetPathParams(map[string]string{"id": parentGroupId}).
+		Post(config.Host + "/auth/admin/realms/" + config.Realm + "/groups/{id}/children")
 	if err != nil {
-		logger.Errorf("create sub group %v failed, error: %v", groupName, err.Error())
-		return err
+		logger.Errorf("create sub group %v failed, error: %v", group.Name, err.Error())
+		return "", false, err
+	}
+	if resp.StatusCode() == http2.StatusConflict {
+		return "", false, nil
 	}
-	if !utils.IsSuccessResponse(resp.StatusCode(), http2.StatusConflict) {
-		errMsg := fmt.Sprintf("create sub group %v response failed, code: %v, error msg: %v", groupName, resp.StatusCode(), string(resp.Body()))
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("create sub group %v response failed, code: %v, error msg: %v", group.Name, resp.StatusCode(), string(resp.Body()))
 		logger.Errorf(errMsg)
 
-		return errors.New(errMsg)
+		return "", false, errors.New(errMsg)
 	}
-	return nil
+	return getIdFromLocation(resp.Header().Get("Location")), true, nil
 }
 
-func groupCreateEngine(token, groupName string) error {
-	logger.Debugf("creating first class group %v", groupName)
-
-	m := make(map[string]string)
-	m["name"] = groupName
+func groupCreateEngine(ctx context.Context, token string, group *keycloak.GroupInfo) (groupId string, created bool, err error) {
+	logger := log.FromContext(ctx)
+	logger.Debugf("creating first class group %v", group.Name)
 
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
-		SetBody(m).
+		SetBody(group).
 		Post(config.Host + "/auth/admin/realms/" + config.Realm + "/groups")
 	if err != nil {
-		logger.Errorf("create first class group  %v failed, error: %v", groupName, err.Error())
-		return err
+		logger.Errorf("create first class group  %v failed, error: %v", group.Name, err.Error())
+		return "", false, err
+	}
+	if resp.StatusCode() == http2.StatusConflict {
+		return "", false, nil
 	}
-	if !utils.IsSuccessResponse(resp.StatusCode(), http2.StatusConflict) {
-		errMsg := fmt.Sprintf("create first class group %v failed, code: %v, error msg: %v", groupName, resp.StatusCode(), string(resp.Body()))
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("create first class group %v failed, code: %v, error msg: %v", group.Name, resp.StatusCode(), string(resp.Body()))
 		logger.Errorf(errMsg)
 
-		return errors.New(errMsg)
+		return "", false, errors.New(errMsg)
 	}
-	return nil
+	return getIdFromLocation(resp.Header().Get("Location")), true, nil
+}
+
+// getIdFromLocation keycloak returns the url of the created resource in header Location, the last segment is its id
+func getIdFromLocation(location string) string {
+	return location[strings.LastIndex(location, "/")+1:]
 }
 
-func groupDelete(token string, msg *lm.ContactDepMsg) error {
+func groupDelete(ctx context.Context, token string, msg *lm.ContactDepMsg) error {
+	logger := log.FromContext(ctx)
 	groupObj := msg.Event.Object
 
-	fullGroupNameInLark, err := lark.GetFullDepName(groupObj.OpenDepartmentID)
+	group, err := getGroupByDepId(ctx, token, groupObj.OpenDepartmentID)
 	if err != nil {
 		return err
 	}
-
-	// get group id in keycloak by name
-	groupId, err := getGroupIdByName(token, fullGroupNameInLark)
-	if err != nil {
-		// todo group 找不到时不报错
-		return err
+	if group == nil {
+		logger.Infof("cannot find group of department %v in keycloak, skip delete action", groupObj.OpenDepartmentID)
+		return nil
 	}
+	ctx = withKeycloakId(ctx, group.ID)
+	logger = log.FromContext(ctx)
 
-	err = groupDeleteEngine(token, groupId)
+	err = removeGroupOfDep(ctx, token, group.ID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return revokeLeaderRoleIfIdle(ctx, token, group.GetAttribute(attributeLarkLeaderOpenId))
 }
 
-func groupDeleteEngine(token, groupId string) error {
+func groupDeleteEngine(ctx context.Context, token, groupId string) error {
+	logger := log.FromContext(ctx)
 	logger.Debugf("deleting group, id: %v", groupId)
 
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
-		Delete(config.Host + "/auth/admin/realms/" + config.Realm + "/groups/" + groupId)
+		SetPathParams(map[string]string{"id": groupId}).
+		Delete(config.Host + "/auth/admin/realms/" + config.Realm + "/groups/{id}")
 	if err != nil {
 		logger.Errorf("delete group %v failed, error: %v", groupId, err.Error())
 		return err
@@ -170,78 +405,63 @@ func groupDeleteEngine(token, groupId string) error {
 	return nil
 }
 
-func groupUpdate(token string, msg *lm.ContactDepMsg) error {
+// groupUpdate applies the department update as a single diff between the department in lark and its group, see
+// diffDepUpdate
+func groupUpdate(ctx context.Context, token string, msg *lm.ContactDepMsg) error {
+	logger := log.FromContext(ctx)
 	depObj := msg.Event.Object
-	depOldObj := msg.Event.OldObject
-
-	// 修改group name
-	if depOldObj.Name != "" {
-		logger.Infof("updating group name(lark) %v to %v", depOldObj.Name, depObj.Name)
-		newFullDepName, err := lark.GetFullDepName(depObj.OpenDepartmentID)
-		if err != nil {
-			return err
-		}
 
-		// 获取原部门的完整路径
-		idx := strings.LastIndex(newFullDepName, depObj.Name)
-		oldFullDepName := newFullDepName[:idx] + depOldObj.Name
-
-		group, err := getGroup(token, oldFullDepName)
-		if err != nil {
-			return err
-		}
-
-		group.Name = depObj.Name
-		if err = groupNameUpdateEngine(token, group); err != nil {
-			return err
-		}
+	// 部门在飞书中被标记为删除时按部门删除处理
+	if depObj.Status.IsDeleted {
+		logger.Infof("department %v is marked as deleted in lark", depObj.OpenDepartmentID)
+		return groupDelete(ctx, token, msg)
 	}
 
-	// 修改group的层级
-	if depOldObj.ParentDepartmentID != "" {
-		logger.Infof("updating group id %v (lark) parent  id %v to %v", depObj.OpenDepartmentID, depOldObj.ParentDepartmentID, depObj.ParentDepartmentID)
-
-		// 获取飞书中部门变更前的上级部门路径
-		oldParentFullDepName, err := lark.GetFullDepName(depOldObj.ParentDepartmentID)
-		if err != nil {
-			return err
-		}
-		// 拼接处飞书中部门变更前，该部门的路径，并获取其在Keycloak中的group id
-		oldFullDepName := oldParentFullDepName + "/" + depObj.Name
-		groupId, err := getGroupIdByName(token, oldFullDepName)
-		if err != nil {
-			return err
-		}
-
-		var newParentId string
-		// 通过飞书中新上级部门的id，获取上级部门在Keycloak中的id。
-		// 根据飞书中新的上级部门parent_department_id是否为"0"，调用Keycloak的API是不一样的。
-		if depObj.ParentDepartmentID != "0" {
-			parentFullDepName, err := lark.GetFullDepName(depObj.ParentDepartmentID)
-			if err != nil {
-				return err
-			}
-			newParentId, err = getGroupIdByName(token, parentFullDepName)
-			if err != nil {
-				return err
-			}
-		}
+	groups, err := getGroups(ctx, token)
+	if err != nil {
+		return err
+	}
+	group := findGroupByDepId(groups, depObj.OpenDepartmentID)
+	if group == nil {
+		// the group is created with the latest department info in lark, nothing left to update
+		logger.Infof("cannot find group of department %v in keycloak, trying to create", depObj.OpenDepartmentID)
+		_, err := ensureGroupForDep(ctx, token, depObj.OpenDepartmentID)
+		return err
+	}
+	ctx = withKeycloakId(ctx, group.ID)
+	logger = log.FromContext(ctx)
 
-		if err = groupParentUpdateEngine(token, groupId, newParentId); err != nil {
-			return err
-		}
-		return nil
+	update, err := diffDepUpdate(ctx, token, groups, group, depObj)
+	if err != nil {
+		return err
+	}
+	if err = applyDepUpdate(ctx, token, update); err != nil {
+		return err
 	}
 
-	return nil
+	// 修改部门负责人
+	return groupLeaderUpdate(ctx, token, group, depObj.LeaderUserID)
 }
 
-func groupParentUpdateEngine(token, groupId, newParentId string) (err error) {
+func groupParentUpdateEngine(ctx context.Context, token, groupId, newParentId string) (err error) {
+	return groupMoveEngine(ctx, token, groupId, "", newParentId)
+}
+
+// groupMoveEngine moves the group below newParentId, or to the top level if newParentId is empty. A non empty name
+// renames the group in the same request, so that neither the old nor the new parent ever sees a name conflict
+// caused by a half applied rename and move.
+func groupMoveEngine(ctx context.Context, token, groupId, name, newParentId string) (err error) {
+	logger := log.FromContext(ctx)
+	body := map[string]string{"id": groupId}
+	if name != "" {
+		body["name"] = name
+	}
 	if newParentId == "" {
 		resp, err := http.Client.R().
+			SetContext(ctx).
 			SetHeader("Content-Type", "application/json").
 			SetHeader("Authorization", token).
-			SetBody(map[string]string{"id": groupId}).
+			SetBody(body).
 			Post(config.Host + "/auth/admin/realms/" + config.Realm + "/groups")
 		if err != nil {
 			logger.Errorf("update group %v to top level in keycloak failed, error: %v", groupId, err.Error())
@@ -254,10 +474,12 @@ func groupParentUpdateEngine(token, groupId, newParentId string) (err error) {
 		}
 	} else {
 		resp, err := http.Client.R().
+			SetContext(ctx).
 			SetHeader("Content-Type", "application/json").
 			SetHeader("Authorization", token).
-			SetBody(map[string]string{"id": groupId}).
-			Post(config.Host + "/auth/admin/realms/" + config.Realm + "/groups/" + newParentId + "/children")
+			SetBody(body).
+			SetPathParams(map[string]string{"id": newParentId}).
+			Post(config.Host + "/auth/admin/realms/" + config.Realm + "/groups/{id}/children")
 		if err != nil {
 			logger.Errorf("update group %v parent id to %v in keycloak failed, error: %v", groupId, newParentId, err.Error())
 			return err
@@ -272,12 +494,21 @@ func groupParentUpdateEngine(token, groupId, newParentId string) (err error) {
 	return nil
 }
 
-func groupNameUpdateEngine(token string, group *keycloak.GroupInfo) (err error) {
+// groupNameUpdateEngine updates the name and attributes of the group
+func groupNameUpdateEngine(ctx context.Context, token string, group *keycloak.GroupInfo) (err error) {
+	logger := log.FromContext(ctx)
+	body := &keycloak.GroupInfo{
+		ID:         group.ID,
+		Name:       group.Name,
+		Attributes: group.Attributes,
+	}
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
-		SetBody(group).
-		Put(config.Host + "/auth/admin/realms/" + config.Realm + "/groups/" + group.ID)
+		SetBody(body).
+		SetPathParams(map[string]string{"id": group.ID}).
+		Put(config.Host + "/auth/admin/realms/" + config.Realm + "/groups/{id}")
 	if err != nil {
 		logger.Errorf("update group %v in keycloak failed, error: %v", group.ID, err.Error())
 		return err
@@ -291,10 +522,14 @@ func groupNameUpdateEngine(token string, group *keycloak.GroupInfo) (err error)
 	return nil
 }
 
-func getGroups(token string) (groups []*keycloak.GroupInfo, err error) {
+// getGroups returns the group tree of the realm, including group attributes
+func getGroups(ctx context.Context, token string) (groups []*keycloak.GroupInfo, err error) {
+	logger := log.FromContext(ctx)
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
+		SetQueryParam("briefRepresentation", "false").
 		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/groups")
 	if err != nil {
 		logger.Errorf("get groups from keycloak failed, error: %v", err.Error())
@@ -316,89 +551,183 @@ func getGroups(token string) (groups []*keycloak.GroupInfo, err error) {
 	return groups, nil
 }
 
-func getGroup(token, fullGroupNameInLark string) (group *keycloak.GroupInfo, err error) {
-	groups, err := getGroups(token)
-	if err != nil {
-		return nil, err
+// isManagedGroup reports whether the group is managed by the adapter. Groups bound to a department before they
+// were marked are managed as well.
+func isManagedGroup(group *keycloak.GroupInfo) bool {
+	return group.GetAttribute(attributeManagedBy) == managedByAdapter || group.GetAttribute(attributeLarkOpenDepartmentId) != ""
+}
+
+// walkGroups calls f for every group in the tree, parents before children. Walking stops when f returns false.
+func walkGroups(groups []*keycloak.GroupInfo, f func(group *keycloak.GroupInfo) bool) bool {
+	for _, group := range groups {
+		if !f(group) {
+			return false
+		}
+		if !walkGroups(group.SubGroups, f) {
+			return false
+		}
 	}
-	if len(groups) == 0 {
-		logger.Errorf("cannot find groups in keycloak")
-		return nil, errors.New("cannot find groups in keycloak")
+	return true
+}
+
+// walkBoundGroups walks the groups like walkGroups but skips archived groups with their subgroups: the subgroups of an
+// archived group keep the attributes of their departments, yet they are archived along with it and not bound any more
+func walkBoundGroups(groups []*keycloak.GroupInfo, f func(group *keycloak.GroupInfo) bool) bool {
+	for _, group := range groups {
+		if isArchivedGroup(group) {
+			continue
+		}
+		if !f(group) {
+			return false
+		}
+		if !walkBoundGroups(group.SubGroups, f) {
+			return false
+		}
 	}
+	return true
+}
 
-	var f func(groups []*keycloak.GroupInfo) *keycloak.GroupInfo
-	f = func(groups []*keycloak.GroupInfo) *keycloak.GroupInfo {
-		for _, item := range groups {
-			if item.Path == fullGroupNameInLark {
-				return item
-			}
-			if item.SubGroups != nil && len(item.SubGroups) > 0 {
-				group = f(item.SubGroups)
-			}
-			if group != nil {
-				return group
-			}
+// findGroupByDepId finds the group bound to the lark department, depId can be either department id or open department id.
+// Archived groups and their subgroups are not bound any more.
+func findGroupByDepId(groups []*keycloak.GroupInfo, depId string) (group *keycloak.GroupInfo) {
+	walkBoundGroups(groups, func(item *keycloak.GroupInfo) bool {
+		if item.GetAttribute(attributeLarkOpenDepartmentId) == depId || item.GetAttribute(attributeLarkDepartmentId) == depId {
+			group = item
+			return false
 		}
-		return nil
+		return true
+	})
+	return group
+}
+
+// getGroupByDepId returns the group bound to the lark department, or nil if it does not exist in keycloak
+func getGroupByDepId(ctx context.Context, token, depId string) (group *keycloak.GroupInfo, err error) {
+	logger := log.FromContext(ctx)
+	groups, err := getGroups(ctx, token)
+	if err != nil {
+		return nil, err
 	}
 
-	group = f(groups)
+	group = findGroupByDepId(groups, depId)
 	if group == nil {
-		errMsg := fmt.Sprintf("cannot find group %v from keycloak", fullGroupNameInLark)
-		logger.Errorf(errMsg)
-		return nil, errors.New(errMsg)
+		logger.Debugf("cannot find group of department %v in keycloak", depId)
 	}
-
 	return group, nil
 }
 
-func getGroupIdByName(token, fullGroupNameInLark string) (groupId string, err error) {
-	groups, err := getGroups(token)
+// getSiblingGroupByName returns the child group of parentGroupId with the name, or the first class group if parentGroupId is empty
+func getSiblingGroupByName(ctx context.Context, token, parentGroupId, name string) (group *keycloak.GroupInfo, err error) {
+	groups, err := getGroups(ctx, token)
 	if err != nil {
-		return "", err
-	}
-	if len(groups) == 0 {
-		return "", errors.New("cannot find groups in keycloak")
+		return nil, err
 	}
 
-	var f func(groups []*keycloak.GroupInfo) string
-	f = func(groups []*keycloak.GroupInfo) string {
-		for _, group := range groups {
-			if group.Path == fullGroupNameInLark {
-				return group.ID
-			}
-			if group.SubGroups != nil && len(group.SubGroups) > 0 {
-				groupId = f(group.SubGroups)
+	siblings := groups
+	if parentGroupId != "" {
+		siblings = nil
+		walkGroups(groups, func(item *keycloak.GroupInfo) bool {
+			if item.ID == parentGroupId {
+				siblings = item.SubGroups
+				return false
 			}
-			if groupId != "" {
-				return groupId
-			}
-		}
-		return ""
+			return true
+		})
 	}
-	groupId = f(groups)
-	if groupId == "" {
-		return "", fmt.Errorf("cannot find group %v in keycloak", fullGroupNameInLark)
+	for _, item := range siblings {
+		if item.Name == name {
+			return item, nil
+		}
 	}
-	return groupId, nil
+	return nil, nil
 }
 
-func getGroupIdInKeycloak(token string, userObj *lm.UserObject) (groupId string, err error) {
-	// 从飞书获取到department信息，格式为"/Dev/HZ Dev/Ops & QA & LBware/Ops"
-	fullGroupNameInLark, err := lark.GetFullDepName(userObj.DepartmentIDs[0])
+// getGroupMembers returns the direct members of the group
+func getGroupMembers(ctx context.Context, token, groupId string) (members []*keycloak.User, err error) {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetQueryParam("max", "10000").
+		SetPathParams(map[string]string{"id": groupId}).
+		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/groups/{id}/members")
 	if err != nil {
-		return "", err
+		logger.Errorf("get members of group %v from keycloak failed, error: %v", groupId, err.Error())
+		return nil, err
 	}
-	if len(fullGroupNameInLark) == 0 {
-		return "", nil
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("get members of group %v from keycloak failed, response code: %v, response bdoy: %v", groupId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
-	// get keycloak group id by name
-	groupId, err = getGroupIdByName(token, fullGroupNameInLark)
+	members = []*keycloak.User{}
+	err = json.Unmarshal(resp.Body(), &members)
 	if err != nil {
-		return "", err
+		logger.Errorf("unmarshal members of group %v failed, error: %v", groupId, err.Error())
+		return nil, err
 	}
+	return members, nil
+}
 
-	return groupId, nil
+// getUserDepIds returns the lark departments whose groups the user should be a member of
+func getUserDepIds(userObj *lm.UserObject) (depIds []string) {
+	seen := map[string]bool{}
+	for _, depId := range userObj.DepartmentIDs {
+		// 飞书后台可以给用户指定部门为公司，此时认为用户不属于该部门
+		if depId == "" || depId == lark.RootDepartmentId || seen[depId] {
+			continue
+		}
+		seen[depId] = true
+		depIds = append(depIds, depId)
+	}
+	return depIds
+}
 
+// getPrimaryDepId returns the primary department of the user, the one marked in orders or with the highest
+// department order, falling back to the first department
+func getPrimaryDepId(userObj *lm.UserObject) string {
+	var primary *lm.UserOrder
+	for _, order := range userObj.Orders {
+		if order == nil || order.DepartmentID == "" || order.DepartmentID == lark.RootDepartmentId {
+			continue
+		}
+		if order.IsPrimaryDept {
+			return order.DepartmentID
+		}
+		// 飞书中department_order越大，该部门在用户的多个部门中排序越靠前
+		if primary == nil || order.DepartmentOrder > primary.DepartmentOrder {
+			primary = order
+		}
+	}
+	if primary != nil {
+		return primary.DepartmentID
+	}
+
+	depIds := getUserDepIds(userObj)
+	if len(depIds) == 0 {
+		return ""
+	}
+	return depIds[0]
+}
+
+// getGroupIdsInKeycloak returns the keycloak groups of all lark departments of the user
+func getGroupIdsInKeycloak(ctx context.Context, token string, userObj *lm.UserObject) (groupIds []string, err error) {
+	lookup := larkDepLookup(ctx)
+	for _, depId := range getUserDepIds(userObj) {
+		inScope, err := depInScope(depId, lookup)
+		if err != nil {
+			return nil, err
+		}
+		if !inScope {
+			continue
+		}
+		// 根据飞书的部门id获取keycloak中对应的group，不存在时按飞书中的部门信息创建
+		groupId, err := ensureGroupForDep(ctx, token, depId)
+		if err != nil {
+			return nil, err
+		}
+		groupIds = append(groupIds, groupId)
+	}
+	return groupIds, nil
 }
@@ -0,0 +1,34 @@
+package keycloak
+
+import (
+	"keycloak-lark-adapter/internal/model/keycloak"
+	"testing"
+)
+
+func TestFindGroupByDepId(t *testing.T) {
+	dev := testGroup("g-dev", testDep("od-dev", "Dev", "0"), "/Dev")
+	gone := testGroup("g-gone", testDep("od-gone", "Gone", "0"), "/archived/Gone")
+	gone.SetAttribute(attributeDeletedAt, "2024-01-01T00:00:00Z")
+	goneChild := testGroup("g-gone-qa", testDep("od-gone-qa", "QA", "od-gone"), "/archived/Gone/QA")
+	gone.SubGroups = []*keycloak.GroupInfo{goneChild}
+	archive := &keycloak.GroupInfo{ID: "g-archived", Name: "archived", Path: "/archived", SubGroups: []*keycloak.GroupInfo{gone}}
+	groups := []*keycloak.GroupInfo{dev, archive}
+
+	tests := []struct {
+		name  string
+		depId string
+		want  *keycloak.GroupInfo
+	}{
+		{name: "bound group", depId: "od-dev", want: dev},
+		{name: "archived group", depId: "od-gone"},
+		{name: "subgroup of archived group", depId: "od-gone-qa"},
+		{name: "unknown department", depId: "od-unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findGroupByDepId(groups, tt.depId); got != tt.want {
+				t.Errorf("findGroupByDepId() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package keycloak
 
 import (
+	"context"
 	"encoding/json"
 	"keycloak-lark-adapter/internal/config"
 	"keycloak-lark-adapter/internal/http"
@@ -17,6 +18,28 @@ const (
 	attributeRealName    = "fullname"
 	attributeNickname    = "nickname"
 
+	attributeLarkOpenId     = "lark_open_id"
+	attributeLarkUnionId    = "lark_union_id"
+	attributeLarkUserId     = "lark_user_id"
+	attributeLarkEmployeeNo = "lark_employee_no"
+	// attributeLarkPrimaryDepartmentId is the open department id of the primary department of the user
+	attributeLarkPrimaryDepartmentId = "lark_primary_department_id"
+
+	attributeLarkDepartmentId     = "lark_department_id"
+	attributeLarkOpenDepartmentId = "lark_open_department_id"
+	// attributeLarkPath is the full path of the department in lark, attributeLarkOrder its order among its siblings
+	attributeLarkPath  = "lark_path"
+	attributeLarkOrder = "lark_order"
+	// metadata of the department in lark, lark_unit_ids has one value per unit
+	attributeLarkChatId      = "lark_chat_id"
+	attributeLarkMemberCount = "lark_member_count"
+	attributeLarkUnitIds     = "lark_unit_ids"
+	// attributeManagedBy marks the groups managed by the adapter, memberships of other groups are never changed
+	attributeManagedBy = "managed_by"
+	managedByAdapter   = "keycloak-lark-adapter"
+
+	usernamePolicyUpdate = "update"
+
 	eventTypeUserUpdate       = "contact.user.updated_v3"
 	eventTypeUserCreate       = "contact.user.created_v3"
 	eventTypeUserDelete       = "contact.user.deleted_v3"
@@ -31,40 +54,90 @@ var (
 
 func Init() {
 	logger = log.Logger
+
+	validateMatchConfig()
+	validateOffboardConfig()
+	validateStaleEventConfig()
+	initNameStrategy()
+	initUsernameStrategy()
+	initEmailTemplate()
+	initAttributeMappings()
+	initRoleRules()
+	initSyncScheduler()
 }
 
+// ProcessContactEvent processes the events with config.EventWorkers workers. Events of the same user or department
+// are processed in order, department events changing the group tree wait for all other events and block the events
+// after them until they are done.
 func ProcessContactEvent(userChan chan *lm.ContactUserMsg, depChan chan *lm.ContactDepMsg) {
+	pool := newWorkerPool(config.EventWorkers)
+	eventPool = pool
+	eventQueueDepth.Set(0)
 	go func(userChan chan *lm.ContactUserMsg, depChan chan *lm.ContactDepMsg) {
 		for {
 			select {
 			case msg := <-userChan:
-				logger.Debugf("preparing to process contact user msg: %v", msg)
-
-				if msg == nil || msg.Header == nil || msg.Header.EventType == "" {
-					logger.Errorf("cannot get event type from msg: %#v", msg)
+				if msg == nil || msg.Header == nil || msg.Header.EventType == "" || msg.Event == nil || msg.Event.Object == nil {
+					logger.Errorf("cannot get event type from contact user msg")
+					deadLetterEvent(context.Background(), lm.DeadLetterInvalid, msg, nil)
 					continue
 				}
-				err := processUserMsgWithType(msg)
-				if err != nil {
-					logger.Errorf("process contact msg failed, msg: %#v, error: %v", msg, err)
+				header, openId := msg.Header, msg.Event.Object.OpenID
+				logger.WithFields(logrus.Fields{fieldEventId: header.EventID, fieldEventType: header.EventType, fieldLarkOpenId: openId}).
+					Debugf("preparing to process contact user msg")
+				if eventIds.seen(header.EventID) {
+					logger.Infof("skip duplicated %v event %v", header.EventType, header.EventID)
+					eventsDeduplicatedTotal.WithLabelValues(entityUser, header.EventType).Inc()
+					continue
 				}
+				pool.dispatch(entityUser+":"+openId, func() {
+					ctx, finish := startEvent(context.Background(), header, fieldLarkOpenId, openId)
+					err := runEvent(entityUser, header, func() error { return processUserMsgWithType(ctx, msg) })
+					defer finish(err)
+					if err != nil {
+						log.FromContext(ctx).Errorf("process contact user msg failed, error: %v", err)
+						deadLetterEvent(ctx, lm.DeadLetterFailed, msg, err)
+					}
+				})
 			case msg := <-depChan:
-				logger.Debugf("preparing to process contact department msg: %v", msg)
-				if msg == nil || msg.Header == nil || msg.Header.EventType == "" {
-					logger.Errorf("cannot get event type from msg: %#v", msg)
+				if msg == nil || msg.Header == nil || msg.Header.EventType == "" || msg.Event == nil || msg.Event.Object == nil {
+					logger.Errorf("cannot get event type from contact department msg")
+					deadLetterEvent(context.Background(), lm.DeadLetterInvalid, msg, nil)
+					continue
+				}
+				header, depId := msg.Header, msg.Event.Object.OpenDepartmentID
+				logger.WithFields(logrus.Fields{fieldEventId: header.EventID, fieldEventType: header.EventType, fieldDepartmentId: depId}).
+					Debugf("preparing to process contact department msg")
+				if eventIds.seen(header.EventID) {
+					logger.Infof("skip duplicated %v event %v", header.EventType, header.EventID)
+					eventsDeduplicatedTotal.WithLabelValues(entityDepartment, header.EventType).Inc()
 					continue
 				}
-				err := processDepMsgWithType(msg)
-				if err != nil {
-					logger.Errorf("process contact msg failed, msg: %#v, error: %v", msg, err)
+				task := func() {
+					ctx, finish := startEvent(context.Background(), header, fieldDepartmentId, depId)
+					err := runEvent(entityDepartment, header, func() error { return processDepMsgWithType(ctx, msg) })
+					defer finish(err)
+					if err != nil {
+						log.FromContext(ctx).Errorf("process contact department msg failed, error: %v", err)
+						deadLetterEvent(ctx, lm.DeadLetterFailed, msg, err)
+					}
+				}
+				if isBarrierDepEvent(msg) {
+					pool.barrier(task)
+				} else {
+					pool.dispatch(entityDepartment+":"+depId, task)
 				}
 			}
 		}
 	}(userChan, depChan)
 }
 
-func getAppToken() (token string, err error) {
+func getAppToken(ctx context.Context) (token string, err error) {
+	logger := log.FromContext(ctx)
+	defer func() { http.CountTokenRefresh(http.ServiceKeycloak, token != "") }()
+
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/x-www-form-urlencoded").
 		SetFormData(map[string]string{"client_id": config.ClientId, "grant_type": "client_credentials", "client_secret": config.ClientSecret}).
 		Post(config.Host + "/auth/realms/" + config.Realm + "/protocol/openid-connect/token")
@@ -0,0 +1,206 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"keycloak-lark-adapter/cmd/lark"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+)
+
+const (
+	// group attributes of the department leader
+	attributeLarkLeaderOpenId = "lark_leader_open_id"
+	attributeLeader           = "leader"
+	// user attributes of the manager, the lark leader of the user
+	attributeLarkManagerOpenId = "lark_manager_open_id"
+	attributeManager           = "manager"
+	// attributeLeaderRoleGranted marks the users DEPARTMENT_LEADER_ROLE is granted to by the adapter, the role is
+	// revoked from them only. Users the role is granted to otherwise keep it.
+	attributeLeaderRoleGranted = "leader_role_granted"
+
+	leaderFormatId = "id"
+)
+
+// leaderValue returns the value of the leader and manager attributes for the lark user: its email, or its keycloak
+// user id if LEADER_ATTRIBUTE_FORMAT is id. "" is returned if the keycloak user does not exist yet.
+func leaderValue(ctx context.Context, token, openId string) (string, error) {
+	if openId == "" {
+		return "", nil
+	}
+	userObj, err := lark.GetUser(ctx, openId)
+	if err != nil {
+		return "", err
+	}
+	if config.LeaderAttributeFormat != leaderFormatId {
+		return userObj.Email, nil
+	}
+
+	user, err := findUser(ctx, token, userObj)
+	if err != nil || user == nil {
+		return "", err
+	}
+	return user.Id, nil
+}
+
+// setGroupLeader sets the leader attributes of the group, they are removed if the department has no leader
+func setGroupLeader(group *keycloak.GroupInfo, openId, value string) {
+	if group.Attributes == nil {
+		group.Attributes = map[string]interface{}{}
+	}
+	delete(group.Attributes, attributeLarkLeaderOpenId)
+	delete(group.Attributes, attributeLeader)
+	if openId != "" {
+		group.SetAttribute(attributeLarkLeaderOpenId, openId)
+	}
+	if value != "" {
+		group.SetAttribute(attributeLeader, value)
+	}
+}
+
+// setUserManager sets the manager attributes of the user, they are removed if the user has no leader in lark
+func setUserManager(attrs map[string]interface{}, openId, value string) {
+	delete(attrs, attributeLarkManagerOpenId)
+	delete(attrs, attributeManager)
+	if openId != "" {
+		attrs[attributeLarkManagerOpenId] = openId
+	}
+	if value != "" {
+		attrs[attributeManager] = value
+	}
+}
+
+// groupLeaderUpdate updates the leader attributes of the group and moves the leader role from the old leader to the new one
+func groupLeaderUpdate(ctx context.Context, token string, group *keycloak.GroupInfo, leaderOpenId string) error {
+	logger := log.FromContext(ctx)
+	oldLeaderOpenId := group.GetAttribute(attributeLarkLeaderOpenId)
+	leader, err := leaderValue(ctx, token, leaderOpenId)
+	if err != nil {
+		return err
+	}
+	if oldLeaderOpenId == leaderOpenId && group.GetAttribute(attributeLeader) == leader {
+		return nil
+	}
+
+	logger.Infof("updating leader of group %v from %v to %v", group.Path, oldLeaderOpenId, leaderOpenId)
+	setGroupLeader(group, leaderOpenId, leader)
+	if err = groupNameUpdateEngine(ctx, token, group); err != nil {
+		return err
+	}
+
+	if err = grantLeaderRole(ctx, token, leaderOpenId); err != nil {
+		return err
+	}
+	if oldLeaderOpenId != leaderOpenId {
+		return revokeLeaderRoleIfIdle(ctx, token, oldLeaderOpenId)
+	}
+	return nil
+}
+
+// grantLeaderRole grants DEPARTMENT_LEADER_ROLE to the keycloak user of the lark user
+func grantLeaderRole(ctx context.Context, token, openId string) error {
+	logger := log.FromContext(ctx)
+	if config.DepartmentLeaderRole == "" || openId == "" {
+		return nil
+	}
+
+	userObj, err := lark.GetUser(ctx, openId)
+	if err != nil {
+		return err
+	}
+	user, err := findUser(ctx, token, userObj)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		logger.Infof("cannot find leader %v in keycloak, skip granting role %v", describeUser(userObj), config.DepartmentLeaderRole)
+		return nil
+	}
+
+	return grantLeaderRoleToUser(ctx, token, user.Id)
+}
+
+// revokeLeaderRoleIfIdle revokes DEPARTMENT_LEADER_ROLE from the lark user if it does not lead any department any more
+func revokeLeaderRoleIfIdle(ctx context.Context, token, openId string) error {
+	if config.DepartmentLeaderRole == "" || openId == "" {
+		return nil
+	}
+
+	groups, err := getGroups(ctx, token)
+	if err != nil {
+		return err
+	}
+	leading := !walkBoundGroups(groups, func(group *keycloak.GroupInfo) bool {
+		return group.GetAttribute(attributeLarkLeaderOpenId) != openId
+	})
+	if leading {
+		return nil
+	}
+
+	// the user may be deleted in lark already, it is matched by its open id only
+	user, err := findUser(ctx, token, &lm.UserObject{OpenID: openId})
+	if err != nil || user == nil {
+		return err
+	}
+	return revokeLeaderRoleFromUser(ctx, token, user.Id)
+}
+
+// grantLeaderRoleToUser grants DEPARTMENT_LEADER_ROLE to the keycloak user and marks it as granted by the adapter.
+// Users already holding the role are left as they are, they keep it when they no longer lead a department.
+func grantLeaderRoleToUser(ctx context.Context, token, userId string) error {
+	logger := log.FromContext(ctx)
+	user, err := getUserById(ctx, token, userId)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %v does not exist in keycloak", userId)
+	}
+	roles, err := userRoleSpecs(ctx, token, userId)
+	if err != nil {
+		return err
+	}
+	if roles[config.DepartmentLeaderRole] {
+		return nil
+	}
+
+	role, err := getRealmRole(ctx, token, config.DepartmentLeaderRole)
+	if err != nil {
+		return err
+	}
+	logger.Infof("granting role %v to leader %v", role.Name, user.Username)
+	if err = userRealmRolesAddEngine(ctx, token, userId, []*keycloak.Role{role}); err != nil {
+		return err
+	}
+	if user.Attributes == nil {
+		user.Attributes = map[string]interface{}{}
+	}
+	user.Attributes[attributeLeaderRoleGranted] = []string{"true"}
+	return updateUser(ctx, token, userId, user)
+}
+
+// revokeLeaderRoleFromUser revokes DEPARTMENT_LEADER_ROLE from the keycloak user if it is granted by the adapter
+func revokeLeaderRoleFromUser(ctx context.Context, token, userId string) error {
+	logger := log.FromContext(ctx)
+	user, err := getUserById(ctx, token, userId)
+	if err != nil || user == nil {
+		return err
+	}
+	if user.GetAttribute(attributeLeaderRoleGranted) == "" {
+		logger.Infof("role %v of user %v is not granted by the adapter, keep it", config.DepartmentLeaderRole, user.Username)
+		return nil
+	}
+
+	role, err := getRealmRole(ctx, token, config.DepartmentLeaderRole)
+	if err != nil {
+		return err
+	}
+	logger.Infof("user %v does not lead any department, revoking role %v", user.Username, role.Name)
+	if err = userRealmRolesDeleteEngine(ctx, token, userId, []*keycloak.Role{role}); err != nil {
+		return err
+	}
+	delete(user.Attributes, attributeLeaderRoleGranted)
+	return updateUser(ctx, token, userId, user)
+}
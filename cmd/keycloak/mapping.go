@@ -0,0 +1,223 @@
+package keycloak
+
+import (
+	"bytes"
+	"encoding/json"
+	"keycloak-lark-adapter/internal/config"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	targetFirstName        = "firstName"
+	targetLastName         = "lastName"
+	targetEmail            = "email"
+	targetAttributesPrefix = "attributes."
+
+	transformLowercase = "lowercase"
+	transformUppercase = "uppercase"
+	transformTrim      = "trim"
+	transformEnum      = "enum"
+	transformRealName  = "real_name"
+	transformNickname  = "nickname"
+	// transformDate formats a unix timestamp in seconds, such as join_time, with the go layout after the colon
+	transformDatePrefix = "date:"
+)
+
+// AttributeMapping maps a lark user field, or a template over the lark user fields, to a keycloak user field
+type AttributeMapping struct {
+	// Source is the json name of the lark user field, nested fields are separated by dots, e.g. avatar.avatar_72
+	Source string `json:"source,omitempty"`
+	// Template is a go template over the lark user fields, e.g. "{{.en_name}} ({{.employee_no}})", used if Source is empty
+	Template string `json:"template,omitempty"`
+	// Target is firstName, lastName, email or attributes.<name>
+	Target     string            `json:"target"`
+	Transforms []string          `json:"transforms,omitempty"`
+	Enum       map[string]string `json:"enum,omitempty"`
+	// Default is used if the mapped value is empty
+	Default string `json:"default,omitempty"`
+
+	tmpl *template.Template
+}
+
+// defaultAttributeMappings are the mappings of earlier versions, ATTRIBUTE_MAPPINGS are applied after them
+var defaultAttributeMappings = []*AttributeMapping{
+	{Source: "mobile", Target: targetAttributesPrefix + attributePhoneNumber},
+	{Source: "name", Target: targetAttributesPrefix + attributeRealName, Transforms: []string{transformRealName}},
+	{Source: "name", Target: targetAttributesPrefix + attributeNickname, Transforms: []string{transformNickname}},
+	{Source: fieldGivenName, Target: targetFirstName},
+	{Source: fieldFamilyName, Target: targetLastName},
+}
+
+var attributeMappings []*AttributeMapping
+
+func initAttributeMappings() {
+	attributeMappings = defaultAttributeMappings
+	if config.AttributeMappings == "" {
+		return
+	}
+
+	var mappings []*AttributeMapping
+	if err := json.Unmarshal([]byte(config.AttributeMappings), &mappings); err != nil {
+		logger.Fatalf("invalid param ATTRIBUTE_MAPPINGS, error: %v", err)
+	}
+	for _, mapping := range mappings {
+		if mapping.Source == "" && mapping.Template == "" {
+			logger.Fatalf("attribute mapping to %v has neither source nor template", mapping.Target)
+		}
+		switch {
+		case mapping.Target == targetFirstName, mapping.Target == targetLastName, mapping.Target == targetEmail:
+		case strings.HasPrefix(mapping.Target, targetAttributesPrefix) && len(mapping.Target) > len(targetAttributesPrefix):
+		default:
+			logger.Fatalf("unsupported attribute mapping target %v, should be firstName, lastName, email or attributes.<name>", mapping.Target)
+		}
+		for _, transform := range mapping.Transforms {
+			switch {
+			case transform == transformLowercase, transform == transformUppercase, transform == transformTrim,
+				transform == transformRealName, transform == transformNickname:
+			case transform == transformEnum:
+				if len(mapping.Enum) == 0 {
+					logger.Fatalf("attribute mapping to %v uses transform enum without enum values", mapping.Target)
+				}
+			case strings.HasPrefix(transform, transformDatePrefix):
+			default:
+				logger.Fatalf("unsupported transform %v in attribute mapping to %v", transform, mapping.Target)
+			}
+		}
+		if mapping.Template != "" {
+			tmpl, err := template.New(mapping.Target).Parse(mapping.Template)
+			if err != nil {
+				logger.Fatalf("invalid template in attribute mapping to %v, error: %v", mapping.Target, err)
+			}
+			mapping.tmpl = tmpl
+		}
+		attributeMappings = append(attributeMappings, mapping)
+	}
+}
+
+// applyAttributeMappings sets the mapped fields of the keycloak user from the lark user, attributes with an empty
+// value are removed
+func applyAttributeMappings(user *keycloak.User, userObj *lm.UserObject) {
+	if user.Attributes == nil {
+		user.Attributes = map[string]interface{}{}
+	}
+	fields := larkUserFields(userObj)
+	for _, mapping := range attributeMappings {
+		value := mapping.value(fields)
+		switch mapping.Target {
+		case targetFirstName:
+			user.FirstName = value
+		case targetLastName:
+			user.LastName = value
+		case targetEmail:
+			user.Email = value
+		default:
+			key := strings.TrimPrefix(mapping.Target, targetAttributesPrefix)
+			if value == "" {
+				delete(user.Attributes, key)
+			} else {
+				user.Attributes[key] = value
+			}
+		}
+	}
+}
+
+// mappedAttributeKeys returns the attributes written by the mappings
+func mappedAttributeKeys() (keys []string) {
+	for _, mapping := range attributeMappings {
+		if strings.HasPrefix(mapping.Target, targetAttributesPrefix) {
+			keys = append(keys, strings.TrimPrefix(mapping.Target, targetAttributesPrefix))
+		}
+	}
+	return keys
+}
+
+func (m *AttributeMapping) value(fields map[string]interface{}) string {
+	var value string
+	if m.tmpl != nil {
+		buf := new(bytes.Buffer)
+		if err := m.tmpl.Execute(buf, fields); err != nil {
+			logger.Warnf("execute template of attribute mapping to %v failed, error: %v", m.Target, err)
+		}
+		// missing fields are rendered as "<no value>"
+		value = strings.Replace(buf.String(), "<no value>", "", -1)
+	} else {
+		value = fieldValue(fields, m.Source)
+	}
+
+	for _, transform := range m.Transforms {
+		switch {
+		case transform == transformLowercase:
+			value = strings.ToLower(value)
+		case transform == transformUppercase:
+			value = strings.ToUpper(value)
+		case transform == transformTrim:
+			value = strings.TrimSpace(value)
+		case transform == transformEnum:
+			value = m.Enum[value]
+		case transform == transformRealName:
+			value, _ = parseName(value)
+		case transform == transformNickname:
+			_, value = parseName(value)
+		case strings.HasPrefix(transform, transformDatePrefix):
+			if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds > 0 {
+				value = time.Unix(seconds, 0).UTC().Format(strings.TrimPrefix(transform, transformDatePrefix))
+			} else {
+				value = ""
+			}
+		}
+	}
+
+	if value == "" {
+		value = m.Default
+	}
+	return value
+}
+
+// larkUserFields converts the lark user to a map keyed by the json field names, numbers are kept as written by lark.
+// The given and family name computed by NAME_STRATEGY are added as given_name and family_name.
+func larkUserFields(userObj *lm.UserObject) map[string]interface{} {
+	fields := map[string]interface{}{}
+	buf, err := json.Marshal(userObj)
+	if err != nil {
+		logger.Errorf("marshal lark user %v failed, error: %v", describeUser(userObj), err)
+		return fields
+	}
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	if err = decoder.Decode(&fields); err != nil {
+		logger.Errorf("unmarshal lark user %v failed, error: %v", describeUser(userObj), err)
+	}
+	fields[fieldGivenName], fields[fieldFamilyName] = splitName(userObj)
+	return fields
+}
+
+// fieldValue returns the value of a dotted path such as avatar.avatar_72 as string, "" if it does not exist
+func fieldValue(fields map[string]interface{}, path string) string {
+	var value interface{} = fields
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		buf, _ := json.Marshal(v)
+		return string(buf)
+	}
+}
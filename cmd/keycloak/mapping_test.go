@@ -0,0 +1,107 @@
+package keycloak
+
+import (
+	"keycloak-lark-adapter/internal/config"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"testing"
+	"text/template"
+)
+
+func TestAttributeMappingValue(t *testing.T) {
+	config.NameStrategy = nameStrategyParenthesis
+	userObj := &lm.UserObject{
+		Name:         "Tom(张三)",
+		EnName:       "Tom Zhang",
+		EmployeeNo:   "  E001 ",
+		EmployeeType: 2,
+		JoinTime:     1704067200,
+		Avatar:       &lm.UserAvatar{Avatar72: "https://example.com/72.png"},
+	}
+	fields := larkUserFields(userObj)
+
+	tests := []struct {
+		name    string
+		mapping *AttributeMapping
+		want    string
+	}{
+		{name: "source", mapping: &AttributeMapping{Source: "en_name"}, want: "Tom Zhang"},
+		{name: "nested source", mapping: &AttributeMapping{Source: "avatar.avatar_72"}, want: "https://example.com/72.png"},
+		{name: "number source", mapping: &AttributeMapping{Source: "employee_type"}, want: "2"},
+		{name: "missing source", mapping: &AttributeMapping{Source: "avatar.missing"}},
+		{name: "given name", mapping: &AttributeMapping{Source: fieldGivenName}, want: "张三"},
+		{name: "template", mapping: &AttributeMapping{Template: "{{.en_name}} ({{.employee_type}})"}, want: "Tom Zhang (2)"},
+		{name: "template strips missing fields", mapping: &AttributeMapping{Template: "{{.en_name}}{{.missing}}"}, want: "Tom Zhang"},
+		{name: "trim", mapping: &AttributeMapping{Source: "employee_no", Transforms: []string{transformTrim}}, want: "E001"},
+		{
+			name:    "transforms in order",
+			mapping: &AttributeMapping{Source: "employee_no", Transforms: []string{transformTrim, transformLowercase}},
+			want:    "e001",
+		},
+		{name: "uppercase", mapping: &AttributeMapping{Source: "en_name", Transforms: []string{transformUppercase}}, want: "TOM ZHANG"},
+		{
+			name:    "enum",
+			mapping: &AttributeMapping{Source: "employee_type", Transforms: []string{transformEnum}, Enum: map[string]string{"1": "regular", "2": "intern"}},
+			want:    "intern",
+		},
+		{
+			name:    "enum without value falls back to default",
+			mapping: &AttributeMapping{Source: "employee_type", Transforms: []string{transformEnum}, Enum: map[string]string{"1": "regular"}, Default: "other"},
+			want:    "other",
+		},
+		{name: "real name", mapping: &AttributeMapping{Source: "name", Transforms: []string{transformRealName}}, want: "张三"},
+		{name: "nickname", mapping: &AttributeMapping{Source: "name", Transforms: []string{transformNickname}}, want: "Tom"},
+		{name: "date", mapping: &AttributeMapping{Source: "join_time", Transforms: []string{transformDatePrefix + "2006-01-02"}}, want: "2024-01-01"},
+		{name: "date of no timestamp", mapping: &AttributeMapping{Source: "en_name", Transforms: []string{transformDatePrefix + "2006-01-02"}}},
+		{name: "default", mapping: &AttributeMapping{Source: "city", Default: "unknown"}, want: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mapping.Template != "" {
+				tt.mapping.tmpl = template.Must(template.New(tt.name).Parse(tt.mapping.Template))
+			}
+			if got := tt.mapping.value(fields); got != tt.want {
+				t.Errorf("value() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyAttributeMappings(t *testing.T) {
+	config.NameStrategy = nameStrategyParenthesis
+	config.AttributeMappings = `[
+		{"source": "employee_no", "target": "attributes.employee_no"},
+		{"template": "{{.en_name}}", "target": "firstName", "transforms": ["trim"]},
+		{"source": "city", "target": "attributes.city"}
+	]`
+	defer func() { config.AttributeMappings = "" }()
+	initAttributeMappings()
+	defer func() { attributeMappings = defaultAttributeMappings }()
+
+	user := &keycloak.User{Attributes: map[string]interface{}{"city": "Beijing", "other": "kept"}}
+	applyAttributeMappings(user, &lm.UserObject{Name: "张三", EnName: " Tom ", EmployeeNo: "E001", Mobile: "+8613800000000"})
+
+	if user.FirstName != "Tom" {
+		t.Errorf("firstName = %q, want %q, mappings apply after the default ones", user.FirstName, "Tom")
+	}
+	if user.LastName != "张三" {
+		t.Errorf("lastName = %q, want %q", user.LastName, "张三")
+	}
+	want := map[string]string{
+		"employee_no":        "E001",
+		attributePhoneNumber: "+8613800000000",
+		attributeRealName:    "张三",
+		"other":              "kept",
+	}
+	for key, value := range want {
+		if got := user.GetAttribute(key); got != value {
+			t.Errorf("attribute %v = %q, want %q", key, got, value)
+		}
+	}
+	if _, ok := user.Attributes["city"]; ok {
+		t.Errorf("attribute city with an empty value is not removed")
+	}
+	if _, ok := user.Attributes[attributeNickname]; ok {
+		t.Errorf("attribute %v of a name without nickname is not removed", attributeNickname)
+	}
+}
@@ -0,0 +1,251 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"keycloak-lark-adapter/internal/config"
+	"keycloak-lark-adapter/internal/http"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"keycloak-lark-adapter/pkg/utils"
+	"strings"
+)
+
+const (
+	matcherFederatedLink = "federated_link"
+	matcherOpenId        = "open_id"
+	matcherUnionId       = "union_id"
+	matcherUserId        = "user_id"
+	matcherEmployeeNo    = "employee_no"
+	matcherEmail         = "email"
+	matcherUsername      = "username"
+)
+
+// userMatcher finds the keycloak user of the lark user in userList, returns nil if there is no match
+type userMatcher func(ctx context.Context, token string, userList []*keycloak.User, userObj *lm.UserObject) (*keycloak.User, error)
+
+var userMatchers = map[string]userMatcher{
+	matcherFederatedLink: matchByFederatedLink,
+	matcherOpenId: func(ctx context.Context, token string, userList []*keycloak.User, userObj *lm.UserObject) (*keycloak.User, error) {
+		return matchByAttribute(userList, attributeLarkOpenId, userObj.OpenID), nil
+	},
+	matcherUnionId: func(ctx context.Context, token string, userList []*keycloak.User, userObj *lm.UserObject) (*keycloak.User, error) {
+		return matchByAttribute(userList, attributeLarkUnionId, userObj.UnionID), nil
+	},
+	matcherUserId: func(ctx context.Context, token string, userList []*keycloak.User, userObj *lm.UserObject) (*keycloak.User, error) {
+		return matchByAttribute(userList, attributeLarkUserId, userObj.UserID), nil
+	},
+	matcherEmployeeNo: func(ctx context.Context, token string, userList []*keycloak.User, userObj *lm.UserObject) (*keycloak.User, error) {
+		return matchByAttribute(userList, attributeLarkEmployeeNo, userObj.EmployeeNo), nil
+	},
+	matcherEmail: func(ctx context.Context, token string, userList []*keycloak.User, userObj *lm.UserObject) (*keycloak.User, error) {
+		if userObj.Email == "" {
+			return nil, nil
+		}
+		// users bound to another lark user keep their account even if the email is the same
+		for _, user := range userList {
+			if strings.EqualFold(user.Email, userObj.Email) && !isBoundToOther(user, userObj) {
+				return user, nil
+			}
+		}
+		return nil, nil
+	},
+	matcherUsername: func(ctx context.Context, token string, userList []*keycloak.User, userObj *lm.UserObject) (*keycloak.User, error) {
+		// the username built by USERNAME_STRATEGY, users bound to another lark user own the username by collision
+		for _, user := range userList {
+			if isUsernameOf(user, userObj) {
+				return user, nil
+			}
+		}
+		return nil, nil
+	},
+}
+
+func validateMatchConfig() {
+	for _, name := range config.UserMatchOrder {
+		if _, ok := userMatchers[name]; !ok {
+			logger.Fatalf("unsupported user matcher %v in USER_MATCH_ORDER", name)
+		}
+	}
+
+	switch config.IdpUserIdField {
+	case matcherOpenId, matcherUnionId, matcherUserId:
+	default:
+		logger.Fatalf("unsupported KEYCLOAK_IDP_USER_ID_FIELD %v, should be one of open_id, union_id and user_id", config.IdpUserIdField)
+	}
+}
+
+// findUser finds the keycloak user of the lark user by trying the matchers in config.UserMatchOrder,
+// returns nil if the user does not exist in keycloak
+func findUser(ctx context.Context, token string, userObj *lm.UserObject) (user *keycloak.User, err error) {
+	logger := log.FromContext(ctx)
+	userList, err := getUserList(ctx, token)
+	if err != nil {
+		logger.Errorf("get user list from keycloak failed, error: %v", err.Error())
+		return nil, err
+	}
+
+	user, err = matchUser(ctx, token, userList, nil, userObj)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		logger.Infof("cannot find user %v in keycloak", describeUser(userObj))
+	}
+	return user, nil
+}
+
+// matchUser finds the keycloak user of the lark user in userList by trying the matchers in config.UserMatchOrder.
+// links is the federated link index of userList, see indexFederatedLinks, nil to search keycloak per lark user.
+func matchUser(ctx context.Context, token string, userList []*keycloak.User, links federatedLinks, userObj *lm.UserObject) (user *keycloak.User, err error) {
+	logger := log.FromContext(ctx)
+	for _, name := range config.UserMatchOrder {
+		matcher := userMatchers[name]
+		if name == matcherFederatedLink && links != nil {
+			matcher = links.match
+		}
+		user, err = matcher(ctx, token, userList, userObj)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil {
+			logger.Debugf("user %v matched by %v, keycloak user: %v", describeUser(userObj), name, user.Id)
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+// isBoundToOther reports whether the keycloak user is bound to a lark user other than userObj by lark_open_id
+func isBoundToOther(user *keycloak.User, userObj *lm.UserObject) bool {
+	openId := user.GetAttribute(attributeLarkOpenId)
+	return openId != "" && openId != userObj.OpenID
+}
+
+func matchByAttribute(userList []*keycloak.User, key, value string) *keycloak.User {
+	if value == "" {
+		return nil
+	}
+	for _, user := range userList {
+		if user.GetAttribute(key) == value {
+			return user
+		}
+	}
+	return nil
+}
+
+func matchByFederatedLink(ctx context.Context, token string, userList []*keycloak.User, userObj *lm.UserObject) (*keycloak.User, error) {
+	logger := log.FromContext(ctx)
+	idpUserId := getLarkUserId(userObj, config.IdpUserIdField)
+	if config.IdpAlias == "" || idpUserId == "" {
+		return nil, nil
+	}
+
+	candidates, err := searchUsers(ctx, token, map[string]string{"idpAlias": config.IdpAlias, "idpUserId": idpUserId})
+	if err != nil {
+		return nil, err
+	}
+	// keycloak versions without federated link search ignore the query and return every user
+	if len(candidates) > 1 {
+		logger.Warnf("keycloak returned %v users for federated link %v, skip matching by federated link", len(candidates), idpUserId)
+		return nil, nil
+	}
+
+	for _, candidate := range candidates {
+		links, err := getFederatedIdentities(ctx, token, candidate.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range links {
+			if link.IdentityProvider == config.IdpAlias && link.UserID == idpUserId {
+				for _, user := range userList {
+					if user.Id == candidate.Id {
+						return user, nil
+					}
+				}
+				return candidate, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// federatedLinks maps the lark user ids of the federated links of config.IdpAlias to their keycloak users
+type federatedLinks map[string]*keycloak.User
+
+// indexFederatedLinks reads the federated links of the users once, so a sync matches every lark user against the
+// index rather than searching keycloak per lark user. Returns nil if users are not matched by federated link.
+func indexFederatedLinks(ctx context.Context, token string, userList []*keycloak.User) (federatedLinks, error) {
+	if config.IdpAlias == "" || !containsFold(config.UserMatchOrder, matcherFederatedLink) {
+		return nil, nil
+	}
+	links := federatedLinks{}
+	for _, user := range userList {
+		identities, err := getFederatedIdentities(ctx, token, user.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, identity := range identities {
+			if identity.IdentityProvider == config.IdpAlias && identity.UserID != "" {
+				links[identity.UserID] = user
+			}
+		}
+	}
+	return links, nil
+}
+
+// match is the federated_link matcher of the index
+func (l federatedLinks) match(ctx context.Context, token string, userList []*keycloak.User, userObj *lm.UserObject) (*keycloak.User, error) {
+	return l[getLarkUserId(userObj, config.IdpUserIdField)], nil
+}
+
+func getFederatedIdentities(ctx context.Context, token, userId string) (links []*keycloak.FederatedIdentity, err error) {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Authorization", token).
+		SetPathParams(map[string]string{"id": userId}).
+		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}/federated-identity")
+	if err != nil {
+		logger.Errorf("get user %v federated identities from keycloak failed, error: %v", userId, err.Error())
+		return nil, err
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("get user %v federated identities from keycloak failed, error code: %v, response: %v", userId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	err = json.Unmarshal(resp.Body(), &links)
+	if err != nil {
+		logger.Errorf("unmarshal user %v federated identities failed, error: %v", userId, err)
+		return nil, err
+	}
+	return links, nil
+}
+
+// getLarkUserId returns the lark user id of the given type: open_id, union_id or user_id
+func getLarkUserId(userObj *lm.UserObject, idType string) string {
+	switch idType {
+	case matcherOpenId:
+		return userObj.OpenID
+	case matcherUnionId:
+		return userObj.UnionID
+	case matcherUserId:
+		return userObj.UserID
+	}
+	return ""
+}
+
+// describeUser returns a readable identifier of the lark user for logs, email may be empty in delete events
+func describeUser(userObj *lm.UserObject) string {
+	if userObj.Email != "" {
+		return userObj.Email
+	}
+	if userObj.Name != "" {
+		return fmt.Sprintf("%v(%v)", userObj.Name, userObj.OpenID)
+	}
+	return userObj.OpenID
+}
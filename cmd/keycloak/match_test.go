@@ -0,0 +1,79 @@
+package keycloak
+
+import (
+	"context"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMatchByEmail(t *testing.T) {
+	userObj := &lm.UserObject{OpenID: "ou-alice", Email: "alice@example.com"}
+	unbound := testUser("alice", "")
+	unbound.Email = "Alice@example.com"
+	bound := testUser("alice", "ou-alice")
+	bound.Email = "alice@example.com"
+	other := testUser("alice.old", "ou-bob")
+	other.Email = "alice@example.com"
+
+	tests := []struct {
+		name  string
+		users []*keycloak.User
+		want  *keycloak.User
+	}{
+		{name: "unbound user ignoring case", users: []*keycloak.User{unbound}, want: unbound},
+		{name: "user bound to the lark user", users: []*keycloak.User{bound}, want: bound},
+		{name: "user bound to another lark user", users: []*keycloak.User{other}},
+		{name: "skips the user bound to another lark user", users: []*keycloak.User{other, unbound}, want: unbound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := userMatchers[matcherEmail](context.Background(), "", tt.users, userObj)
+			if err != nil {
+				t.Fatalf("email matcher error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("email matcher = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchByFederatedLinkIndex(t *testing.T) {
+	log.Logger = logrus.New()
+	config.IdpAlias, config.IdpUserIdField = "lark", matcherOpenId
+	config.UserMatchOrder = []string{matcherFederatedLink, matcherEmail}
+	defer func() { config.IdpAlias, config.UserMatchOrder = "", nil }()
+	linked := testUser("alice", "")
+	linked.Id = "kc-alice"
+	byEmail := testUser("bob", "")
+	byEmail.Id, byEmail.Email = "kc-bob", "bob@example.com"
+	users := []*keycloak.User{linked, byEmail}
+	links := federatedLinks{"ou-alice": linked}
+
+	tests := []struct {
+		name    string
+		userObj *lm.UserObject
+		want    *keycloak.User
+	}{
+		{name: "linked", userObj: &lm.UserObject{OpenID: "ou-alice", Email: "bob@example.com"}, want: linked},
+		{name: "not linked", userObj: &lm.UserObject{OpenID: "ou-bob", Email: "bob@example.com"}, want: byEmail},
+		{name: "no match", userObj: &lm.UserObject{OpenID: "ou-carol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the index answers without searching keycloak, the test has no keycloak to search
+			got, err := matchUser(context.Background(), "", users, links, tt.userObj)
+			if err != nil {
+				t.Fatalf("matchUser() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("matchUser() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
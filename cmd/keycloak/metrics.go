@@ -0,0 +1,108 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	log "keycloak-lark-adapter/internal/logger"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// recentEventIds is the number of event ids remembered to drop redelivered events
+const recentEventIds = 1000
+
+var (
+	eventsProcessedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lark_events_processed_total",
+		Help: "Lark contact events processed successfully, by entity and event type.",
+	}, []string{"entity", "type"})
+	eventsFailedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lark_events_failed_total",
+		Help: "Lark contact events whose processing failed, by entity and event type.",
+	}, []string{"entity", "type"})
+	eventsDeduplicatedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lark_events_deduplicated_total",
+		Help: "Lark contact events dropped because an event with the same event id was received already, by entity and event type.",
+	}, []string{"entity", "type"})
+	eventProcessingSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "lark_event_processing_seconds",
+		Help: "Time spent processing a lark contact event, by entity and event type.",
+	}, []string{"entity", "type"})
+	eventLagSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lark_event_lag_seconds",
+		Help:    "Time from the creation of a lark contact event in lark to the end of its processing, by entity.",
+		Buckets: []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600},
+	}, []string{"entity"})
+	eventQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lark_event_queue_depth",
+		Help: "Lark contact events waiting for or being processed by the event workers.",
+	})
+
+	eventIds = newEventDeduplicator(recentEventIds)
+)
+
+// eventDeduplicator remembers the ids of the recent events, lark redelivers an event if it is not acknowledged in time
+type eventDeduplicator struct {
+	lock sync.Mutex
+	ids  map[string]bool
+	// ring holds the ids in the order they were seen, the oldest one is forgotten when it is full
+	ring []string
+	next int
+}
+
+func newEventDeduplicator(size int) *eventDeduplicator {
+	return &eventDeduplicator{ids: map[string]bool{}, ring: make([]string, size)}
+}
+
+// seen reports whether the event id has been seen already and remembers it. Empty ids are never seen.
+func (d *eventDeduplicator) seen(eventId string) bool {
+	if eventId == "" {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.ids[eventId] {
+		return true
+	}
+	if old := d.ring[d.next]; old != "" {
+		delete(d.ids, old)
+	}
+	d.ring[d.next] = eventId
+	d.next = (d.next + 1) % len(d.ring)
+	d.ids[eventId] = true
+	return false
+}
+
+// runEvent processes the event with process and records its outcome, processing time and lag
+func runEvent(entity string, header *lm.ContactMsgHeader, process func() error) error {
+	start := time.Now()
+	err := process()
+	eventProcessingSeconds.WithLabelValues(entity, header.EventType).Observe(time.Since(start).Seconds())
+	if err != nil {
+		eventsFailedTotal.WithLabelValues(entity, header.EventType).Inc()
+	} else {
+		eventsProcessedTotal.WithLabelValues(entity, header.EventType).Inc()
+	}
+	if createTime := eventTime(header); createTime > 0 {
+		lag := time.Since(time.Unix(0, createTime*int64(time.Millisecond)))
+		eventLagSeconds.WithLabelValues(entity).Observe(lag.Seconds())
+	}
+	return err
+}
+
+// deadLetterEvent keeps the event which was not processed, it can be replayed by hand once the cause is fixed
+func deadLetterEvent(ctx context.Context, reason string, msg interface{}, cause error) {
+	logger := log.FromContext(ctx)
+	data, err := json.Marshal(msg)
+	if err == nil {
+		err = lm.DeadLetter(reason, data, cause)
+	}
+	if err != nil {
+		logger.Errorf("dead-letter %v event failed, error: %v", reason, err)
+	}
+}
@@ -0,0 +1,120 @@
+package keycloak
+
+import (
+	"keycloak-lark-adapter/internal/config"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	nameStrategyParenthesis = "parenthesis"
+	nameStrategyEnName      = "en_name"
+	nameStrategyCJK         = "cjk"
+	nameStrategyRegex       = "regex"
+
+	// computed lark user fields, the default mappings of firstName and lastName
+	fieldGivenName  = "given_name"
+	fieldFamilyName = "family_name"
+)
+
+// compoundSurnames are the common chinese compound surnames, other surnames are a single character
+var compoundSurnames = []string{
+	"欧阳", "司马", "诸葛", "上官", "东方", "皇甫", "尉迟", "公孙", "慕容", "长孙", "宇文", "司徒", "夏侯", "轩辕",
+	"令狐", "钟离", "端木", "独孤", "南宫", "西门", "申屠", "太史", "澹台", "公冶", "百里", "东郭", "呼延", "万俟",
+	"闻人", "赫连", "濮阳", "司空", "左丘", "拓跋", "第五", "仲孙", "颛孙", "子车", "亓官", "谷梁", "梁丘", "公羊",
+}
+
+var (
+	nameStrategies = map[string]func(userObj *lm.UserObject) (given, family string){
+		nameStrategyParenthesis: parenthesisName,
+		nameStrategyEnName:      enName,
+		nameStrategyCJK:         cjkName,
+		nameStrategyRegex:       regexName,
+	}
+
+	nameRegex *regexp.Regexp
+)
+
+func initNameStrategy() {
+	if _, ok := nameStrategies[config.NameStrategy]; !ok {
+		logger.Fatalf("unsupported NAME_STRATEGY %v", config.NameStrategy)
+	}
+	if config.NameStrategy != nameStrategyRegex {
+		return
+	}
+
+	var err error
+	nameRegex, err = regexp.Compile(config.NameRegex)
+	if err != nil {
+		logger.Fatalf("invalid param NAME_REGEX %v, error: %v", config.NameRegex, err)
+	}
+	if nameRegex.SubexpIndex(fieldGivenName) < 0 && nameRegex.SubexpIndex(fieldFamilyName) < 0 {
+		logger.Fatalf("NAME_REGEX %v should have the named group given_name or family_name", config.NameRegex)
+	}
+}
+
+// splitName returns the given and family name of the lark user with NAME_STRATEGY
+func splitName(userObj *lm.UserObject) (given, family string) {
+	return nameStrategies[config.NameStrategy](userObj)
+}
+
+// parenthesisName is the convention of earlier versions: both names are the real name of "nickname(real name)"
+func parenthesisName(userObj *lm.UserObject) (given, family string) {
+	realName, _ := parseName(userObj.Name)
+	return realName, realName
+}
+
+// enName splits the english name at the last space, e.g. "Mary Ann Smith", falls back to the parenthesis convention
+func enName(userObj *lm.UserObject) (given, family string) {
+	name := strings.TrimSpace(userObj.EnName)
+	if name == "" {
+		return parenthesisName(userObj)
+	}
+	return splitAtLastSpace(name)
+}
+
+// cjkName splits the real name into the surname, which may be a compound surname, and the given name.
+// Names which are not chinese are split at the last space.
+func cjkName(userObj *lm.UserObject) (given, family string) {
+	realName, _ := parseName(userObj.Name)
+	runes := []rune(realName)
+	if len(runes) == 0 || !unicode.Is(unicode.Han, runes[0]) {
+		return splitAtLastSpace(realName)
+	}
+	if len(runes) == 1 {
+		return realName, ""
+	}
+
+	for _, surname := range compoundSurnames {
+		if strings.HasPrefix(realName, surname) && len(runes) > len([]rune(surname)) {
+			return string(runes[len([]rune(surname)):]), surname
+		}
+	}
+	return string(runes[1:]), string(runes[0])
+}
+
+// regexName extracts the named groups given_name and family_name of NAME_REGEX from the lark name, names which do
+// not match fall back to the parenthesis convention
+func regexName(userObj *lm.UserObject) (given, family string) {
+	match := nameRegex.FindStringSubmatch(userObj.Name)
+	if match == nil {
+		return parenthesisName(userObj)
+	}
+	if i := nameRegex.SubexpIndex(fieldGivenName); i >= 0 {
+		given = strings.TrimSpace(match[i])
+	}
+	if i := nameRegex.SubexpIndex(fieldFamilyName); i >= 0 {
+		family = strings.TrimSpace(match[i])
+	}
+	return given, family
+}
+
+func splitAtLastSpace(name string) (given, family string) {
+	fields := strings.Fields(name)
+	if len(fields) < 2 {
+		return strings.TrimSpace(name), ""
+	}
+	return strings.Join(fields[:len(fields)-1], " "), fields[len(fields)-1]
+}
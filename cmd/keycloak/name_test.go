@@ -0,0 +1,132 @@
+package keycloak
+
+import (
+	"keycloak-lark-adapter/internal/config"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"regexp"
+	"testing"
+)
+
+func TestSplitName(t *testing.T) {
+	tests := []struct {
+		name       string
+		strategy   string
+		regex      string
+		userObj    *lm.UserObject
+		wantGiven  string
+		wantFamily string
+	}{
+		{
+			name:     "parenthesis",
+			strategy: nameStrategyParenthesis,
+			userObj:  &lm.UserObject{Name: "Tom（张三）"},
+			// earlier versions set both names to the real name
+			wantGiven:  "张三",
+			wantFamily: "张三",
+		},
+		{
+			name:       "english name",
+			strategy:   nameStrategyEnName,
+			userObj:    &lm.UserObject{Name: "张三", EnName: "Mary Ann Smith"},
+			wantGiven:  "Mary Ann",
+			wantFamily: "Smith",
+		},
+		{
+			name:       "english name missing",
+			strategy:   nameStrategyEnName,
+			userObj:    &lm.UserObject{Name: "Tom(张三)"},
+			wantGiven:  "张三",
+			wantFamily: "张三",
+		},
+		{
+			name:       "cjk single surname",
+			strategy:   nameStrategyCJK,
+			userObj:    &lm.UserObject{Name: "Tom(张三丰)"},
+			wantGiven:  "三丰",
+			wantFamily: "张",
+		},
+		{
+			name:       "cjk compound surname",
+			strategy:   nameStrategyCJK,
+			userObj:    &lm.UserObject{Name: "欧阳修"},
+			wantGiven:  "修",
+			wantFamily: "欧阳",
+		},
+		{
+			name:       "cjk compound surname only",
+			strategy:   nameStrategyCJK,
+			userObj:    &lm.UserObject{Name: "司马"},
+			wantGiven:  "马",
+			wantFamily: "司",
+		},
+		{
+			name:      "cjk single character",
+			strategy:  nameStrategyCJK,
+			userObj:   &lm.UserObject{Name: "张"},
+			wantGiven: "张",
+		},
+		{
+			name:       "cjk latin name",
+			strategy:   nameStrategyCJK,
+			userObj:    &lm.UserObject{Name: "John Smith"},
+			wantGiven:  "John",
+			wantFamily: "Smith",
+		},
+		{
+			name:       "regex",
+			strategy:   nameStrategyRegex,
+			regex:      `^(?P<family_name>\S+)\s+(?P<given_name>.+)$`,
+			userObj:    &lm.UserObject{Name: "Smith John Paul"},
+			wantGiven:  "John Paul",
+			wantFamily: "Smith",
+		},
+		{
+			name:      "regex with given name only",
+			strategy:  nameStrategyRegex,
+			regex:     `^(?P<given_name>[^-]+)-`,
+			userObj:   &lm.UserObject{Name: "John - Sales"},
+			wantGiven: "John",
+		},
+		{
+			name:       "regex not matching",
+			strategy:   nameStrategyRegex,
+			regex:      `^(?P<family_name>\S+)\s+(?P<given_name>.+)$`,
+			userObj:    &lm.UserObject{Name: "Tom(张三)"},
+			wantGiven:  "张三",
+			wantFamily: "张三",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.NameStrategy = tt.strategy
+			if tt.regex != "" {
+				nameRegex = regexp.MustCompile(tt.regex)
+			}
+			given, family := splitName(tt.userObj)
+			if given != tt.wantGiven || family != tt.wantFamily {
+				t.Errorf("splitName() = %q, %q, want %q, %q", given, family, tt.wantGiven, tt.wantFamily)
+			}
+		})
+	}
+}
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		name         string
+		wantRealName string
+		wantNickname string
+	}{
+		{name: "张三", wantRealName: "张三"},
+		{name: " Tom(张三) ", wantRealName: "张三", wantNickname: "Tom"},
+		{name: "Tom（张三）", wantRealName: "张三", wantNickname: "Tom"},
+		{name: "Tom(张三", wantRealName: "张三", wantNickname: "Tom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			realName, nickname := parseName(tt.name)
+			if realName != tt.wantRealName || nickname != tt.wantNickname {
+				t.Errorf("parseName() = %q, %q, want %q, %q", realName, nickname, tt.wantRealName, tt.wantNickname)
+			}
+		})
+	}
+}
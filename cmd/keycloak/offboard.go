@@ -0,0 +1,392 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"keycloak-lark-adapter/internal/config"
+	"keycloak-lark-adapter/internal/http"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"keycloak-lark-adapter/internal/store"
+	"keycloak-lark-adapter/pkg/utils"
+	http2 "net/http"
+	"strings"
+	"time"
+)
+
+const (
+	offboardDisable      = "disable"
+	offboardRemoveGroups = "remove_groups"
+	offboardMoveAlumni   = "move_alumni"
+	offboardRecordReason = "record_reason"
+
+	offboardReasonFrozen   = "frozen"
+	offboardReasonResigned = "resigned"
+	offboardReasonDeleted  = "deleted"
+	// offboardReasonNotFound users created from lark which the reconciliation no longer finds in lark
+	offboardReasonNotFound = "not_found_in_lark"
+	// offboardReasonOutOfScope users moved out of the scope filters, with OUT_OF_SCOPE_ACTION=offboard
+	offboardReasonOutOfScope = "out_of_scope"
+
+	attributeDisabledReason = "disabled_reason"
+	attributeDisabledAt     = "disabled_at"
+
+	bucketPendingDeletions   = "pending_deletions"
+	pendingDeletionsInterval = time.Minute
+)
+
+// pendingDeletion is a user deletion delayed by config.OffboardDeleteAfter, persisted in the state store
+type pendingDeletion struct {
+	UserId   string    `json:"user_id"`
+	Username string    `json:"username"`
+	Reason   string    `json:"reason"`
+	DeleteAt time.Time `json:"delete_at"`
+}
+
+func validateOffboardConfig() {
+	for _, action := range config.OffboardActions {
+		switch action {
+		case offboardDisable, offboardRemoveGroups, offboardRecordReason:
+		case offboardMoveAlumni:
+			if config.OffboardAlumniGroup == "" {
+				logger.Fatalf("OFFBOARD_ALUMNI_GROUP is required by offboard action %v", action)
+			}
+		default:
+			logger.Fatalf("unsupported offboard action %v in OFFBOARD_ACTIONS", action)
+		}
+	}
+}
+
+func hasOffboardAction(action string) bool {
+	for _, item := range config.OffboardActions {
+		if item == action {
+			return true
+		}
+	}
+	return false
+}
+
+// getOffboardReason returns why the lark user has to be offboarded, or "" if the user is active
+func getOffboardReason(userObj *lm.UserObject) string {
+	if userObj.Status == nil {
+		return ""
+	}
+	if userObj.Status.IsResigned {
+		return offboardReasonResigned
+	}
+	if userObj.Status.IsFrozen {
+		return offboardReasonFrozen
+	}
+	return ""
+}
+
+// isDeletable users who left the company are deleted according to the policy, frozen users and users out of scope
+// may come back and are only disabled
+func isDeletable(reason string) bool {
+	return reason != offboardReasonFrozen && reason != offboardReasonOutOfScope && !config.OffboardDeleteNever
+}
+
+func deletesImmediately(reason string) bool {
+	return isDeletable(reason) && config.OffboardDeleteAfter == 0
+}
+
+func userOffboard(ctx context.Context, token string, userObj *lm.UserObject, reason string) error {
+	logger := log.FromContext(ctx)
+	userInKeycloak, err := findUser(ctx, token, userObj)
+	if err != nil {
+		return err
+	}
+	if userInKeycloak == nil {
+		logger.Infof("cannot find user %v in keycloak, skip offboarding", describeUser(userObj))
+		return nil
+	}
+	return offboardUser(ctx, token, userInKeycloak, reason)
+}
+
+// offboardUser applies the offboarding policy to the keycloak user. Every action checks the current state first,
+// so offboarding a user twice changes nothing.
+func offboardUser(ctx context.Context, token string, user *keycloak.User, reason string) error {
+	ctx = withKeycloakId(ctx, user.Id)
+	logger := log.FromContext(ctx)
+	logger.Infof("offboarding user %v, reason: %v, actions: %v", user.Username, reason, config.OffboardActions)
+
+	if deletesImmediately(reason) {
+		logger.Infof("deleting user %v, reason: %v", user.Username, reason)
+		if err := deleteUserEngine(ctx, token, user.Id); err != nil {
+			return err
+		}
+		return store.Delete(bucketPendingDeletions, user.Id)
+	}
+
+	updated, changed := genUser4Offboard(user, reason)
+	if changed {
+		if err := updateUser(ctx, token, updated.Id, updated); err != nil {
+			return err
+		}
+	}
+
+	if hasOffboardAction(offboardMoveAlumni) || hasOffboardAction(offboardRemoveGroups) {
+		if err := offboardUserGroups(ctx, token, user.Id); err != nil {
+			return err
+		}
+	}
+
+	if isDeletable(reason) {
+		return schedulePendingDeletion(user, reason)
+	}
+	return nil
+}
+
+// genUser4Offboard applies the disable and record_reason actions to a copy of the user
+func genUser4Offboard(user *keycloak.User, reason string) (updated *keycloak.User, changed bool) {
+	updated = new(keycloak.User)
+	*updated = *user
+	updated.Attributes = map[string]interface{}{}
+	for key, value := range user.Attributes {
+		updated.Attributes[key] = value
+	}
+
+	if hasOffboardAction(offboardDisable) && (user.Enabled == nil || *user.Enabled) {
+		enabled := false
+		updated.Enabled = &enabled
+		// the reason marks the user as disabled by the adapter, only such users are enabled again, see isAdapterDisabled
+		updated.Attributes[attributeDisabledReason] = reason
+		changed = true
+	}
+	if hasOffboardAction(offboardRecordReason) && user.GetAttribute(attributeDisabledReason) != reason {
+		updated.Attributes[attributeDisabledReason] = reason
+		updated.Attributes[attributeDisabledAt] = time.Now().UTC().Format(time.RFC3339)
+		changed = true
+	}
+	return updated, changed
+}
+
+// offboardUserGroups moves the user to the alumni group and removes it from the other managed groups
+func offboardUserGroups(ctx context.Context, token, userId string) error {
+	logger := log.FromContext(ctx)
+	userGroups, err := getUserGroups(ctx, token, userId)
+	if err != nil {
+		return err
+	}
+
+	alumniGroupId := ""
+	if hasOffboardAction(offboardMoveAlumni) {
+		alumniGroupId, err = ensureGroupByPath(ctx, token, config.OffboardAlumniGroup)
+		if err != nil {
+			return err
+		}
+		isMember := false
+		for _, ug := range userGroups {
+			isMember = isMember || ug.ID == alumniGroupId
+		}
+		if !isMember {
+			logger.Infof("moving user %v to alumni group %v", userId, config.OffboardAlumniGroup)
+			if err = userGroupAddEngine(ctx, token, userId, alumniGroupId); err != nil {
+				return err
+			}
+		}
+	}
+
+	// moving to the alumni group removes the user from the department groups as remove_groups does
+	groups, err := getGroups(ctx, token)
+	if err != nil {
+		return err
+	}
+	managed := map[string]bool{}
+	walkGroups(groups, func(group *keycloak.GroupInfo) bool {
+		managed[group.ID] = isManagedGroup(group)
+		return true
+	})
+	for _, ug := range userGroups {
+		if ug.ID == alumniGroupId || !managed[ug.ID] {
+			continue
+		}
+		logger.Infof("removing offboarded user %v from group %v", userId, ug.Path)
+		if err = userGroupDeleteEngine(ctx, token, userId, ug.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isAdapterDisabled reports whether the user was offboarded by the adapter, users disabled in keycloak otherwise
+// carry no reason of the adapter and are never enabled by it
+func isAdapterDisabled(user *keycloak.User) bool {
+	switch user.GetAttribute(attributeDisabledReason) {
+	case offboardReasonFrozen, offboardReasonResigned, offboardReasonDeleted, offboardReasonNotFound, offboardReasonOutOfScope:
+		return true
+	}
+	return false
+}
+
+// clearOffboarding removes the offboarding record from the attributes of a user who is active in lark again,
+// returns false if there was nothing to clear
+func clearOffboarding(attrs map[string]interface{}) bool {
+	if keycloak.AttributeValue(attrs, attributeDisabledReason) == "" && keycloak.AttributeValue(attrs, attributeDisabledAt) == "" {
+		return false
+	}
+	delete(attrs, attributeDisabledReason)
+	delete(attrs, attributeDisabledAt)
+	return true
+}
+
+func schedulePendingDeletion(user *keycloak.User, reason string) error {
+	existing := new(pendingDeletion)
+	ok, err := store.Get(bucketPendingDeletions, user.Id, existing)
+	if err != nil {
+		return err
+	}
+	if ok {
+		logger.Debugf("deletion of user %v is already scheduled at %v", user.Username, existing.DeleteAt)
+		return nil
+	}
+
+	deletion := &pendingDeletion{
+		UserId:   user.Id,
+		Username: user.Username,
+		Reason:   reason,
+		DeleteAt: time.Now().Add(config.OffboardDeleteAfter),
+	}
+	logger.Infof("user %v will be deleted at %v, reason: %v", user.Username, deletion.DeleteAt, reason)
+	return store.Put(bucketPendingDeletions, user.Id, deletion)
+}
+
+// cancelPendingDeletion is called when a user becomes active in lark again
+func cancelPendingDeletion(userId string) error {
+	if ok, err := store.Get(bucketPendingDeletions, userId, new(pendingDeletion)); err != nil || !ok {
+		return err
+	}
+	logger.Infof("user %v is active again, cancel its scheduled deletion", userId)
+	return store.Delete(bucketPendingDeletions, userId)
+}
+
+func isPendingDeletion(userId string) bool {
+	ok, _ := store.Get(bucketPendingDeletions, userId, new(pendingDeletion))
+	return ok
+}
+
+// StartPendingDeletions deletes offboarded users whose grace period expired, checking every minute
+func StartPendingDeletions() {
+	go func() {
+		ctx := context.Background()
+		for {
+			processPendingDeletions(ctx)
+			time.Sleep(pendingDeletionsInterval)
+		}
+	}()
+}
+
+func processPendingDeletions(ctx context.Context) {
+	logger := log.FromContext(ctx)
+	now := time.Now()
+	var due []*pendingDeletion
+	for key, raw := range store.List(bucketPendingDeletions) {
+		deletion := new(pendingDeletion)
+		if err := json.Unmarshal(raw, deletion); err != nil {
+			logger.Errorf("unmarshal pending deletion %v failed, error: %v", key, err)
+			continue
+		}
+		if !deletion.DeleteAt.After(now) {
+			due = append(due, deletion)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	token, err := getAppToken(ctx)
+	if err != nil {
+		return
+	}
+	for _, deletion := range due {
+		user, err := getUserById(ctx, token, deletion.UserId)
+		if err != nil {
+			continue
+		}
+		// the user was deleted by someone else, or enabled again manually
+		if user != nil && (user.Enabled == nil || !*user.Enabled || !hasOffboardAction(offboardDisable)) {
+			logger.Infof("grace period of user %v expired, deleting it, reason: %v", deletion.Username, deletion.Reason)
+			if err = deleteUserEngine(ctx, token, deletion.UserId); err != nil {
+				continue
+			}
+		} else if user != nil {
+			logger.Warnf("user %v was enabled again in keycloak, cancel its scheduled deletion", deletion.Username)
+		}
+		if err = store.Delete(bucketPendingDeletions, deletion.UserId); err != nil {
+			logger.Errorf("remove pending deletion of user %v failed, error: %v", deletion.Username, err)
+		}
+	}
+}
+
+// getUserById returns the keycloak user, or nil if it does not exist
+func getUserById(ctx context.Context, token, userId string) (user *keycloak.User, err error) {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Authorization", token).
+		SetPathParams(map[string]string{"id": userId}).
+		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}")
+	if err != nil {
+		logger.Errorf("get user %v from keycloak failed, error: %v", userId, err.Error())
+		return nil, err
+	}
+	if resp.StatusCode() == http2.StatusNotFound {
+		return nil, nil
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("get user %v from keycloak failed, error code: %v, response: %v", userId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	user = new(keycloak.User)
+	if err = json.Unmarshal(resp.Body(), user); err != nil {
+		logger.Errorf("unmarshal user %v failed, error: %v", userId, err)
+		return nil, err
+	}
+	return user, nil
+}
+
+// ensureGroupByPath returns the id of the group at path such as "/alumni", missing groups on the path are created
+// and marked as managed by the adapter
+func ensureGroupByPath(ctx context.Context, token, path string) (groupId string, err error) {
+	logger := log.FromContext(ctx)
+	groups, err := getGroups(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	siblings := groups
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		var group *keycloak.GroupInfo
+		for _, item := range siblings {
+			if item.Name == name {
+				group = item
+			}
+		}
+		if group != nil {
+			groupId, siblings = group.ID, group.SubGroups
+			continue
+		}
+
+		group = &keycloak.GroupInfo{Name: name}
+		group.SetAttribute(attributeManagedBy, managedByAdapter)
+		logger.Infof("creating group %v of path %v", name, path)
+		var created bool
+		if groupId == "" {
+			groupId, created, err = groupCreateEngine(ctx, token, group)
+		} else {
+			groupId, created, err = subGroupCreateEngine(ctx, token, group, groupId)
+		}
+		if err != nil {
+			return "", err
+		}
+		if !created {
+			return "", fmt.Errorf("create group %v of path %v conflicted", name, path)
+		}
+		siblings = nil
+	}
+	return groupId, nil
+}
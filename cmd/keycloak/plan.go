@@ -0,0 +1,254 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"keycloak-lark-adapter/internal/config"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	opCreateGroup      = "create_group"
+	opUpdateGroup      = "update_group"
+	opMoveGroup        = "move_group"
+	opCreateUser       = "create_user"
+	opUpdateUser       = "update_user"
+	opAddMembership    = "add_membership"
+	opRemoveMembership = "remove_membership"
+	opGrantRole        = "grant_role"
+	opRevokeRole       = "revoke_role"
+	opOffboardUser     = "offboard_user"
+	opDeleteUser       = "delete_user"
+	opArchiveGroup     = "archive_group"
+	opDeleteGroup      = "delete_group"
+
+	// keycloak access tokens are short-lived, the token is refreshed while a long plan is applied
+	applyTokenTTL = time.Minute
+)
+
+// opOrder is the order in which changes are applied: groups have to exist before users are added to them,
+// and groups are deleted only after their members have been moved out
+var opOrder = []string{
+	opCreateGroup,
+	opUpdateGroup,
+	opMoveGroup,
+	opCreateUser,
+	opUpdateUser,
+	opAddMembership,
+	opRemoveMembership,
+	opGrantRole,
+	opRevokeRole,
+	opOffboardUser,
+	opDeleteUser,
+	opArchiveGroup,
+	opDeleteGroup,
+}
+
+// Plan is the list of changes which brings keycloak in line with lark, sorted in the order they are applied
+type Plan struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Changes     []*Change `json:"changes"`
+
+	// keycloak ids of the groups and users which exist before the plan is applied
+	groupIds map[string]string
+	userIds  map[string]string
+	// managed is the number of keycloak groups and users bound to lark before the plan is applied
+	managed int
+	// fetchedAt is the time the state of lark was fetched, the plan applies the events created before
+	fetchedAt time.Time
+}
+
+// Change is a single write to keycloak
+type Change struct {
+	Op string `json:"op"`
+	// Target is a readable name of the changed group or user, e.g. the group path or the username
+	Target     string       `json:"target"`
+	LarkId     string       `json:"lark_id,omitempty"`
+	KeycloakId string       `json:"keycloak_id,omitempty"`
+	Reason     string       `json:"reason,omitempty"`
+	Diffs      []*FieldDiff `json:"diffs,omitempty"`
+
+	apply func(ctx context.Context, s *applyState) error
+}
+
+// FieldDiff is the change of a single field, attributes are named "attributes.<key>"
+type FieldDiff struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// applyState resolves the keycloak ids of groups and users created by earlier changes of the plan
+type applyState struct {
+	token     string
+	tokenTime time.Time
+	// lark open department id -> keycloak group id
+	groupIds map[string]string
+	// lark open id -> keycloak user id
+	userIds map[string]string
+}
+
+// planReport is the plan grouped by operation, in the order the operations are applied
+type planReport struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	Total       int             `json:"total"`
+	Operations  []*planReportOp `json:"operations"`
+}
+
+type planReportOp struct {
+	Op      string    `json:"op"`
+	Count   int       `json:"count"`
+	Changes []*Change `json:"changes"`
+}
+
+func newPlan() *Plan {
+	return &Plan{
+		GeneratedAt: time.Now(),
+		groupIds:    map[string]string{},
+		userIds:     map[string]string{},
+	}
+}
+
+func (p *Plan) add(change *Change) {
+	p.Changes = append(p.Changes, change)
+}
+
+// deletions returns the number of changes removing a group or user: a partial listing from lark makes every group
+// and user missing from it look deleted
+func (p *Plan) deletions() int {
+	var n int
+	for _, change := range p.Changes {
+		switch change.Op {
+		case opDeleteGroup, opArchiveGroup, opOffboardUser, opDeleteUser:
+			n++
+		}
+	}
+	return n
+}
+
+// isGroupTreeChange reports whether the change creates, renames, moves or removes a group
+func isGroupTreeChange(op string) bool {
+	switch op {
+	case opCreateGroup, opUpdateGroup, opMoveGroup, opArchiveGroup, opDeleteGroup:
+		return true
+	}
+	return false
+}
+
+// changeEntity returns the entity the lark id of the change belongs to
+func changeEntity(op string) string {
+	if isGroupTreeChange(op) {
+		return entityDepartment
+	}
+	return entityUser
+}
+
+// checkDeletions returns an error if the plan removes more groups and users than SYNC_MAX_DELETIONS allows
+func (p *Plan) checkDeletions() error {
+	limit := config.SyncMaxDeletions
+	if limit < 0 {
+		return nil
+	}
+	if config.SyncMaxDeletionsPercent {
+		// rounded up, 10% of a realm of 5 allows 1 deletion rather than none
+		limit = (p.managed*limit + 99) / 100
+	}
+	if deletions := p.deletions(); deletions > limit {
+		return fmt.Errorf("plan deletes, archives or offboards %v of %v groups and users bound to lark, more than SYNC_MAX_DELETIONS %v allows, nothing applied. Review it with the sync command in dry-run mode and apply it with -force",
+			deletions, p.managed, limit)
+	}
+	return nil
+}
+
+// sort orders the changes by opOrder, changes of the same operation keep the order they were added in
+func (p *Plan) sort() {
+	rank := make(map[string]int, len(opOrder))
+	for i, op := range opOrder {
+		rank[op] = i
+	}
+	sort.SliceStable(p.Changes, func(i, j int) bool {
+		return rank[p.Changes[i].Op] < rank[p.Changes[j].Op]
+	})
+}
+
+func (s *applyState) getToken(ctx context.Context) (string, error) {
+	if s.token != "" && time.Since(s.tokenTime) < applyTokenTTL {
+		return s.token, nil
+	}
+	token, err := getAppToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.tokenTime = time.Now()
+	return token, nil
+}
+
+func diffField(diffs []*FieldDiff, field, old, new string) []*FieldDiff {
+	if old == new {
+		return diffs
+	}
+	return append(diffs, &FieldDiff{Field: field, Old: old, New: new})
+}
+
+func (p *Plan) report() *planReport {
+	report := &planReport{GeneratedAt: p.GeneratedAt, Total: len(p.Changes), Operations: []*planReportOp{}}
+	for _, op := range opOrder {
+		var changes []*Change
+		for _, change := range p.Changes {
+			if change.Op == op {
+				changes = append(changes, change)
+			}
+		}
+		if len(changes) > 0 {
+			report.Operations = append(report.Operations, &planReportOp{Op: op, Count: len(changes), Changes: changes})
+		}
+	}
+	return report
+}
+
+// JSON renders the plan grouped by operation as machine-readable json
+func (p *Plan) JSON() ([]byte, error) {
+	return json.MarshalIndent(p.report(), "", "  ")
+}
+
+// Text renders the plan grouped by operation as human-readable text
+func (p *Plan) Text() string {
+	report := p.report()
+
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "Sync plan generated at %v, %v changes\n", report.GeneratedAt.Format(time.RFC3339), report.Total)
+	for _, op := range report.Operations {
+		fmt.Fprintf(b, "\n%v (%v)\n", op.Op, op.Count)
+		for _, change := range op.Changes {
+			fmt.Fprintf(b, "  %v %v", opSymbol(op.Op), change.Target)
+			if change.LarkId != "" {
+				fmt.Fprintf(b, " lark: %v", change.LarkId)
+			}
+			if change.KeycloakId != "" {
+				fmt.Fprintf(b, " keycloak: %v", change.KeycloakId)
+			}
+			if change.Reason != "" {
+				fmt.Fprintf(b, " (%v)", change.Reason)
+			}
+			b.WriteString("\n")
+			for _, diff := range change.Diffs {
+				fmt.Fprintf(b, "      %v: %q -> %q\n", diff.Field, diff.Old, diff.New)
+			}
+		}
+	}
+	return b.String()
+}
+
+func opSymbol(op string) string {
+	switch op {
+	case opCreateGroup, opCreateUser, opAddMembership, opGrantRole:
+		return "+"
+	case opDeleteGroup, opDeleteUser, opOffboardUser, opRemoveMembership, opRevokeRole:
+		return "-"
+	}
+	return "~"
+}
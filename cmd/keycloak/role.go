@@ -0,0 +1,241 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"keycloak-lark-adapter/internal/config"
+	"keycloak-lark-adapter/internal/http"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	"keycloak-lark-adapter/pkg/utils"
+)
+
+// getRealmRole returns the realm role by name
+func getRealmRole(ctx context.Context, token, name string) (role *keycloak.Role, err error) {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetPathParams(map[string]string{"role": name}).
+		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/roles/{role}")
+	if err != nil {
+		logger.Errorf("get realm role %v failed, error: %v", name, err.Error())
+		return nil, err
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("get realm role %v failed, response code: %v, response bdoy: %v", name, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+
+	role = new(keycloak.Role)
+	if err = json.Unmarshal(resp.Body(), role); err != nil {
+		logger.Errorf("unmarshal realm role %v failed, error: %v", name, err)
+		return nil, err
+	}
+	return role, nil
+}
+
+// getRoleUsers returns the users the realm role is granted to directly
+func getRoleUsers(ctx context.Context, token, name string) (users []*keycloak.User, err error) {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetQueryParam("max", "10000").
+		SetPathParams(map[string]string{"role": name}).
+		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/roles/{role}/users")
+	if err != nil {
+		logger.Errorf("get users of realm role %v failed, error: %v", name, err.Error())
+		return nil, err
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("get users of realm role %v failed, response code: %v, response bdoy: %v", name, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+
+	if err = json.Unmarshal(resp.Body(), &users); err != nil {
+		logger.Errorf("unmarshal users of realm role %v failed, error: %v", name, err)
+		return nil, err
+	}
+	return users, nil
+}
+
+// userRealmRolesAddEngine grants the realm roles to the user
+func userRealmRolesAddEngine(ctx context.Context, token, userId string, roles []*keycloak.Role) error {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetBody(roles).
+		SetPathParams(map[string]string{"id": userId}).
+		Post(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}/role-mappings/realm")
+	if err != nil {
+		logger.Errorf("grant realm roles to user %v failed, error: %v", userId, err.Error())
+		return err
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("grant realm roles to user %v failed, response code: %v, response bdoy: %v", userId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return errors.New(errMsg)
+	}
+	return nil
+}
+
+// userRealmRolesDeleteEngine revokes the realm roles from the user
+func userRealmRolesDeleteEngine(ctx context.Context, token, userId string, roles []*keycloak.Role) error {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetBody(roles).
+		SetPathParams(map[string]string{"id": userId}).
+		Delete(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}/role-mappings/realm")
+	if err != nil {
+		logger.Errorf("revoke realm roles from user %v failed, error: %v", userId, err.Error())
+		return err
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("revoke realm roles from user %v failed, response code: %v, response bdoy: %v", userId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return errors.New(errMsg)
+	}
+	return nil
+}
+
+// getClientByClientId returns the client by its client id, such as "gitlab"
+func getClientByClientId(ctx context.Context, token, clientId string) (client *keycloak.Client, err error) {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetQueryParam("clientId", clientId).
+		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/clients")
+	if err != nil {
+		logger.Errorf("get client %v failed, error: %v", clientId, err.Error())
+		return nil, err
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("get client %v failed, response code: %v, response bdoy: %v", clientId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+
+	var clients []*keycloak.Client
+	if err = json.Unmarshal(resp.Body(), &clients); err != nil {
+		logger.Errorf("unmarshal client %v failed, error: %v", clientId, err)
+		return nil, err
+	}
+	for _, item := range clients {
+		if item.ClientID == clientId {
+			return item, nil
+		}
+	}
+	return nil, fmt.Errorf("client %v does not exist in keycloak", clientId)
+}
+
+// getClientRole returns the role of the client, clientUUID is the internal id of the client
+func getClientRole(ctx context.Context, token, clientUUID, name string) (role *keycloak.Role, err error) {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetPathParams(map[string]string{"client": clientUUID, "role": name}).
+		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/clients/{client}/roles/{role}")
+	if err != nil {
+		logger.Errorf("get client role %v failed, error: %v", name, err.Error())
+		return nil, err
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("get client role %v failed, response code: %v, response bdoy: %v", name, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+
+	role = new(keycloak.Role)
+	if err = json.Unmarshal(resp.Body(), role); err != nil {
+		logger.Errorf("unmarshal client role %v failed, error: %v", name, err)
+		return nil, err
+	}
+	return role, nil
+}
+
+// getUserRoleMappings returns the realm and client roles granted to the user directly
+func getUserRoleMappings(ctx context.Context, token, userId string) (mappings *keycloak.RoleMappings, err error) {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetPathParams(map[string]string{"id": userId}).
+		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}/role-mappings")
+	if err != nil {
+		logger.Errorf("get role mappings of user %v failed, error: %v", userId, err.Error())
+		return nil, err
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("get role mappings of user %v failed, response code: %v, response bdoy: %v", userId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+
+	mappings = new(keycloak.RoleMappings)
+	if err = json.Unmarshal(resp.Body(), mappings); err != nil {
+		logger.Errorf("unmarshal role mappings of user %v failed, error: %v", userId, err)
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// userClientRolesAddEngine grants the client roles to the user
+func userClientRolesAddEngine(ctx context.Context, token, userId, clientUUID string, roles []*keycloak.Role) error {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetBody(roles).
+		SetPathParams(map[string]string{"id": userId, "client": clientUUID}).
+		Post(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}/role-mappings/clients/{client}")
+	if err != nil {
+		logger.Errorf("grant client roles to user %v failed, error: %v", userId, err.Error())
+		return err
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("grant client roles to user %v failed, response code: %v, response bdoy: %v", userId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return errors.New(errMsg)
+	}
+	return nil
+}
+
+// userClientRolesDeleteEngine revokes the client roles from the user
+func userClientRolesDeleteEngine(ctx context.Context, token, userId, clientUUID string, roles []*keycloak.Role) error {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetBody(roles).
+		SetPathParams(map[string]string{"id": userId, "client": clientUUID}).
+		Delete(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}/role-mappings/clients/{client}")
+	if err != nil {
+		logger.Errorf("revoke client roles from user %v failed, error: %v", userId, err.Error())
+		return err
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("revoke client roles from user %v failed, response code: %v, response bdoy: %v", userId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return errors.New(errMsg)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"keycloak-lark-adapter/cmd/lark"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"sort"
+	"strings"
+)
+
+// attributeGrantedRoles records the roles granted by role rules, roles granted otherwise are never revoked
+const attributeGrantedRoles = "granted_roles"
+
+// RoleRule grants Roles to the lark users matching all of its conditions, an empty condition matches every user.
+// Roles are realm roles such as "offline_access", or client roles written as "<client id>:<role>".
+type RoleRule struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+	// Departments are department paths such as "/Dev", users of the departments and their subdepartments match
+	Departments   []string `json:"departments,omitempty"`
+	EmployeeTypes []int    `json:"employee_types,omitempty"`
+	JobTitles     []string `json:"job_titles,omitempty"`
+	Cities        []string `json:"cities,omitempty"`
+}
+
+var roleRules []*RoleRule
+
+func initRoleRules() {
+	if config.RoleRules == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(config.RoleRules), &roleRules); err != nil {
+		logger.Fatalf("invalid param ROLE_RULES, error: %v", err)
+	}
+	for i, rule := range roleRules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %v", i+1)
+		}
+		if len(rule.Roles) == 0 {
+			logger.Fatalf("role rule %v has no roles", rule.Name)
+		}
+		for j, dep := range rule.Departments {
+			rule.Departments[j] = "/" + strings.Trim(dep, "/")
+		}
+	}
+}
+
+func (r *RoleRule) match(userObj *lm.UserObject, depPaths []string) bool {
+	if len(r.Departments) > 0 {
+		matched := false
+		for _, prefix := range r.Departments {
+			for _, path := range depPaths {
+				matched = matched || path == prefix || strings.HasPrefix(path, prefix+"/")
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.EmployeeTypes) > 0 {
+		matched := false
+		for _, employeeType := range r.EmployeeTypes {
+			matched = matched || employeeType == userObj.EmployeeType
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.JobTitles) > 0 && !containsFold(r.JobTitles, userObj.JobTitle) {
+		return false
+	}
+	if len(r.Cities) > 0 && !containsFold(r.Cities, userObj.City) {
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// desiredRuleRoles returns the roles the rules grant to the lark user, depPaths are the paths of its departments
+func desiredRuleRoles(userObj *lm.UserObject, depPaths []string) map[string]bool {
+	roles := map[string]bool{}
+	for _, rule := range roleRules {
+		if rule.match(userObj, depPaths) {
+			for _, role := range rule.Roles {
+				roles[role] = true
+			}
+		}
+	}
+	return roles
+}
+
+// ruleRoleChanges compares the roles the rules grant with the roles of the user. Roles the user holds already are
+// not granted, so that they are not tracked and stay when the rule stops matching.
+func ruleRoleChanges(desired, actual, tracked map[string]bool) (grant, revoke []string) {
+	for _, role := range sortedKeys(desired) {
+		if !actual[role] {
+			grant = append(grant, role)
+		}
+	}
+	for _, role := range sortedKeys(tracked) {
+		if !desired[role] {
+			revoke = append(revoke, role)
+		}
+	}
+	return grant, revoke
+}
+
+// userRoleSpecs returns the roles granted to the user directly in the format of RoleRule.Roles
+func userRoleSpecs(ctx context.Context, token, userId string) (map[string]bool, error) {
+	mappings, err := getUserRoleMappings(ctx, token, userId)
+	if err != nil {
+		return nil, err
+	}
+	roles := map[string]bool{}
+	for _, role := range mappings.RealmMappings {
+		roles[role.Name] = true
+	}
+	for clientId, client := range mappings.ClientMappings {
+		for _, role := range client.Mappings {
+			roles[clientId+":"+role.Name] = true
+		}
+	}
+	return roles, nil
+}
+
+func trackedRuleRoles(user *keycloak.User) map[string]bool {
+	roles := map[string]bool{}
+	for _, role := range keycloak.AttributeValues(user.Attributes, attributeGrantedRoles) {
+		roles[role] = true
+	}
+	return roles
+}
+
+// userRoleRulesUpdate applies the role rules to the keycloak user of the lark user
+func userRoleRulesUpdate(ctx context.Context, token string, userObj *lm.UserObject) error {
+	if len(roleRules) == 0 {
+		return nil
+	}
+
+	user, err := findUser(ctx, token, userObj)
+	if err != nil || user == nil {
+		return err
+	}
+	var depPaths []string
+	for _, depId := range getUserDepIds(userObj) {
+		path, err := lark.GetFullDepName(ctx, depId)
+		if err != nil {
+			return err
+		}
+		depPaths = append(depPaths, path)
+	}
+	actual, err := userRoleSpecs(ctx, token, user.Id)
+	if err != nil {
+		return err
+	}
+
+	grant, revoke := ruleRoleChanges(desiredRuleRoles(userObj, depPaths), actual, trackedRuleRoles(user))
+	if len(grant) == 0 && len(revoke) == 0 {
+		return nil
+	}
+	return updateRuleRoles(ctx, token, user.Id, grant, revoke)
+}
+
+// updateRuleRoles grants and revokes the roles and records the roles granted by rules in the granted_roles attribute
+func updateRuleRoles(ctx context.Context, token, userId string, grant, revoke []string) error {
+	logger := log.FromContext(ctx)
+	user, err := getUserById(ctx, token, userId)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %v does not exist in keycloak", userId)
+	}
+	actual, err := userRoleSpecs(ctx, token, userId)
+	if err != nil {
+		return err
+	}
+	tracked := trackedRuleRoles(user)
+
+	for _, spec := range grant {
+		if actual[spec] {
+			continue
+		}
+		logger.Infof("granting role %v to user %v by role rules", spec, user.Username)
+		if err = changeUserRole(ctx, token, userId, spec, true); err != nil {
+			return err
+		}
+		tracked[spec] = true
+	}
+	for _, spec := range revoke {
+		if actual[spec] && tracked[spec] {
+			logger.Infof("revoking role %v from user %v, no role rule matches", spec, user.Username)
+			if err = changeUserRole(ctx, token, userId, spec, false); err != nil {
+				return err
+			}
+		}
+		delete(tracked, spec)
+	}
+
+	roles := sortedKeys(tracked)
+	old := keycloak.AttributeValues(user.Attributes, attributeGrantedRoles)
+	sort.Strings(old)
+	if strings.Join(old, ",") == strings.Join(roles, ",") {
+		return nil
+	}
+	if user.Attributes == nil {
+		user.Attributes = map[string]interface{}{}
+	}
+	if len(roles) == 0 {
+		delete(user.Attributes, attributeGrantedRoles)
+	} else {
+		user.Attributes[attributeGrantedRoles] = roles
+	}
+	return updateUser(ctx, token, userId, user)
+}
+
+// changeUserRole grants or revokes a realm role, or a client role written as "<client id>:<role>"
+func changeUserRole(ctx context.Context, token, userId, spec string, grant bool) error {
+	idx := strings.Index(spec, ":")
+	if idx < 0 {
+		role, err := getRealmRole(ctx, token, spec)
+		if err != nil {
+			return err
+		}
+		if grant {
+			return userRealmRolesAddEngine(ctx, token, userId, []*keycloak.Role{role})
+		}
+		return userRealmRolesDeleteEngine(ctx, token, userId, []*keycloak.Role{role})
+	}
+
+	client, err := getClientByClientId(ctx, token, spec[:idx])
+	if err != nil {
+		return err
+	}
+	role, err := getClientRole(ctx, token, client.ID, spec[idx+1:])
+	if err != nil {
+		return err
+	}
+	if grant {
+		return userClientRolesAddEngine(ctx, token, userId, client.ID, []*keycloak.Role{role})
+	}
+	return userClientRolesDeleteEngine(ctx, token, userId, client.ID, []*keycloak.Role{role})
+}
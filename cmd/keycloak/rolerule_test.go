@@ -0,0 +1,99 @@
+package keycloak
+
+import (
+	"keycloak-lark-adapter/internal/config"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"reflect"
+	"testing"
+)
+
+func TestRoleRuleMatch(t *testing.T) {
+	userObj := &lm.UserObject{EmployeeType: 1, JobTitle: "Engineer", City: "Shanghai"}
+	depPaths := []string{"/Dev/QA", "/Ops"}
+
+	tests := []struct {
+		name string
+		rule *RoleRule
+		want bool
+	}{
+		{name: "no conditions", rule: &RoleRule{}, want: true},
+		{name: "department", rule: &RoleRule{Departments: []string{"/Ops"}}, want: true},
+		{name: "parent department", rule: &RoleRule{Departments: []string{"/Dev"}}, want: true},
+		{name: "department with the same prefix", rule: &RoleRule{Departments: []string{"/De"}}},
+		{name: "other department", rule: &RoleRule{Departments: []string{"/Sales"}}},
+		{name: "employee type", rule: &RoleRule{EmployeeTypes: []int{2, 1}}, want: true},
+		{name: "other employee type", rule: &RoleRule{EmployeeTypes: []int{2}}},
+		{name: "job title ignoring case", rule: &RoleRule{JobTitles: []string{"engineer"}}, want: true},
+		{name: "other job title", rule: &RoleRule{JobTitles: []string{"Manager"}}},
+		{name: "city", rule: &RoleRule{Cities: []string{"Beijing", "SHANGHAI"}}, want: true},
+		{
+			name: "all conditions",
+			rule: &RoleRule{Departments: []string{"/Dev"}, EmployeeTypes: []int{1}, JobTitles: []string{"Engineer"}, Cities: []string{"Shanghai"}},
+			want: true,
+		},
+		{
+			name: "one condition failing",
+			rule: &RoleRule{Departments: []string{"/Dev"}, EmployeeTypes: []int{1}, Cities: []string{"Beijing"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.match(userObj, depPaths); got != tt.want {
+				t.Errorf("match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitRoleRules(t *testing.T) {
+	config.RoleRules = `[
+		{"roles": ["developer"], "departments": ["Dev/", "/Ops"]},
+		{"name": "interns", "roles": ["app:viewer"], "employee_types": [2]}
+	]`
+	defer func() { config.RoleRules, roleRules = "", nil }()
+	initRoleRules()
+
+	if roleRules[0].Name != "rule 1" || roleRules[1].Name != "interns" {
+		t.Errorf("rule names = %v, %v, want rule 1, interns", roleRules[0].Name, roleRules[1].Name)
+	}
+	if want := []string{"/Dev", "/Ops"}; !reflect.DeepEqual(roleRules[0].Departments, want) {
+		t.Errorf("departments = %v, want %v", roleRules[0].Departments, want)
+	}
+
+	got := desiredRuleRoles(&lm.UserObject{EmployeeType: 2}, []string{"/Dev/QA"})
+	if want := map[string]bool{"developer": true, "app:viewer": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("desiredRuleRoles() = %v, want %v", got, want)
+	}
+}
+
+func TestRuleRoleChanges(t *testing.T) {
+	tests := []struct {
+		name       string
+		desired    []string
+		actual     []string
+		tracked    []string
+		wantGrant  []string
+		wantRevoke []string
+	}{
+		{name: "grants missing roles", desired: []string{"b", "a"}, wantGrant: []string{"a", "b"}},
+		{name: "skips roles held already", desired: []string{"a"}, actual: []string{"a"}},
+		{name: "revokes tracked roles no rule grants", actual: []string{"a"}, tracked: []string{"a"}, wantRevoke: []string{"a"}},
+		{name: "keeps roles granted otherwise", actual: []string{"admin"}},
+		{name: "keeps tracked roles still granted", desired: []string{"a"}, actual: []string{"a"}, tracked: []string{"a"}},
+	}
+	set := func(items []string) map[string]bool {
+		m := map[string]bool{}
+		for _, item := range items {
+			m[item] = true
+		}
+		return m
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grant, revoke := ruleRoleChanges(set(tt.desired), set(tt.actual), set(tt.tracked))
+			if !reflect.DeepEqual(grant, tt.wantGrant) || !reflect.DeepEqual(revoke, tt.wantRevoke) {
+				t.Errorf("ruleRoleChanges() = %v, %v, want %v, %v", grant, revoke, tt.wantGrant, tt.wantRevoke)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+)
+
+// rootGroupId returns the id of KEYCLOAK_ROOT_GROUP, the group of the lark root department. The root group is
+// created if missing, "" is returned if no root group is configured and first class departments are first class groups.
+func rootGroupId(ctx context.Context, token string) (string, error) {
+	if config.RootGroup == "" {
+		return "", nil
+	}
+	return ensureGroupByPath(ctx, token, config.RootGroup)
+}
+
+// rootPath returns the keycloak path of the lark root department
+func rootPath() string {
+	if config.RootGroup == "" {
+		return "/"
+	}
+	return config.RootGroup
+}
+
+// larkGroupPath returns the keycloak path of the group of a lark department path such as "/Dev/QA"
+func larkGroupPath(depPath string) string {
+	return config.RootGroup + depPath
+}
+
+// isRootParent reports whether parent, the parent group of a group bound to a department, is the group of the lark
+// root department. nil stands for first class groups.
+func isRootParent(parent *keycloak.GroupInfo) bool {
+	if parent == nil {
+		return config.RootGroup == ""
+	}
+	return parent.Path == config.RootGroup
+}
+
+// MigrateRootGroup moves the first class groups bound to lark departments under KEYCLOAK_ROOT_GROUP, their subgroups,
+// members and role mappings move along. Groups whose name is already taken under the root group are skipped, so it
+// is safe to run more than once.
+func MigrateRootGroup(ctx context.Context, dryRun bool) error {
+	logger := log.FromContext(ctx)
+	if config.RootGroup == "" {
+		return fmt.Errorf("KEYCLOAK_ROOT_GROUP is not set, nothing to migrate")
+	}
+	token, err := getAppToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	groups, err := getGroups(ctx, token)
+	if err != nil {
+		return err
+	}
+	var root *keycloak.GroupInfo
+	for _, group := range groups {
+		if group.Path == config.RootGroup {
+			root = group
+		}
+	}
+	taken := map[string]bool{}
+	if root != nil {
+		for _, group := range root.SubGroups {
+			taken[group.Name] = true
+		}
+	}
+	// the root group is created if missing, a dry run writes nothing
+	var parentId string
+	if !dryRun {
+		if parentId, err = rootGroupId(ctx, token); err != nil {
+			return err
+		}
+	}
+
+	var moved, conflicted int
+	for _, group := range groups {
+		if group.GetAttribute(attributeLarkOpenDepartmentId) == "" || isArchivedGroup(group) || group == root {
+			continue
+		}
+		if taken[group.Name] {
+			logger.Errorf("group %v already exists under %v, skip moving group %v", group.Name, config.RootGroup, group.Path)
+			conflicted++
+			continue
+		}
+		if dryRun {
+			logger.Infof("would move group %v under %v", group.Path, config.RootGroup)
+			moved++
+			continue
+		}
+
+		logger.Infof("moving group %v under %v", group.Path, config.RootGroup)
+		if err = groupParentUpdateEngine(ctx, token, group.ID, parentId); err != nil {
+			return err
+		}
+		taken[group.Name] = true
+		moved++
+	}
+
+	logger.Infof("migrate root group finished, moved: %v, conflicted: %v, dry run: %v", moved, conflicted, dryRun)
+	if conflicted > 0 {
+		return fmt.Errorf("%v groups conflict with groups under %v, rename them and run again", conflicted, config.RootGroup)
+	}
+	return nil
+}
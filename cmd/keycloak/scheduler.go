@@ -0,0 +1,175 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"keycloak-lark-adapter/internal/config"
+	"keycloak-lark-adapter/pkg/cron"
+	"keycloak-lark-adapter/pkg/trace"
+	"math/rand"
+	"sync"
+	"time"
+
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	syncRunSucceeded = "succeeded"
+	syncRunFailed    = "failed"
+	syncRunAborted   = "aborted"
+)
+
+// SyncRun is the result of a scheduled reconciliation
+type SyncRun struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Status is one of succeeded, failed and aborted, aborted runs exceeded config.SyncMaxChanges or
+	// config.SyncMaxDeletions and wrote nothing
+	Status  string `json:"status"`
+	Changes int    `json:"changes"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SyncStatus reports the state of the periodic reconciliation
+type SyncStatus struct {
+	Enabled  bool       `json:"enabled"`
+	Schedule string     `json:"schedule,omitempty"`
+	Running  bool       `json:"running"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	LastRun  *SyncRun   `json:"last_run,omitempty"`
+}
+
+var (
+	syncSchedule *cron.Schedule
+	syncJitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	syncStatusLock sync.Mutex
+	syncStatus     = &SyncStatus{}
+)
+
+func initSyncScheduler() {
+	if config.SyncCron != "" {
+		schedule, err := cron.Parse(config.SyncCron)
+		if err != nil {
+			logger.Fatalf("invalid param SYNC_CRON, error: %v", err)
+		}
+		syncSchedule = schedule
+		syncStatus.Schedule = "cron " + config.SyncCron
+	} else if config.SyncInterval > 0 {
+		syncStatus.Schedule = "every " + config.SyncInterval.String()
+	}
+	syncStatus.Enabled = syncStatus.Schedule != ""
+}
+
+// StartSyncScheduler runs the reconciliation periodically in the background if SYNC_INTERVAL or SYNC_CRON is set.
+// Runs never overlap, a run starts only after the previous one finished.
+func StartSyncScheduler() {
+	if !syncStatus.Enabled {
+		return
+	}
+	logger.Infof("periodic sync enabled, schedule: %v, jitter: %v, max changes: %v", syncStatus.Schedule, config.SyncJitter, config.SyncMaxChanges)
+
+	go func() {
+		for {
+			next := nextSyncTime(time.Now())
+			if next.IsZero() {
+				logger.Errorf("cron expression %v never matches, periodic sync stopped", config.SyncCron)
+				return
+			}
+			syncStatusLock.Lock()
+			syncStatus.NextRun = &next
+			syncStatusLock.Unlock()
+
+			time.Sleep(time.Until(next))
+			runScheduledSync()
+		}
+	}()
+}
+
+// GetSyncStatus returns a copy of the periodic reconciliation status
+func GetSyncStatus() *SyncStatus {
+	syncStatusLock.Lock()
+	defer syncStatusLock.Unlock()
+
+	status := *syncStatus
+	if syncStatus.NextRun != nil {
+		nextRun := *syncStatus.NextRun
+		status.NextRun = &nextRun
+	}
+	if syncStatus.LastRun != nil {
+		lastRun := *syncStatus.LastRun
+		status.LastRun = &lastRun
+	}
+	return &status
+}
+
+func nextSyncTime(now time.Time) time.Time {
+	var next time.Time
+	if syncSchedule != nil {
+		next = syncSchedule.Next(now)
+		if next.IsZero() {
+			return next
+		}
+	} else {
+		next = now.Add(config.SyncInterval)
+	}
+	if config.SyncJitter > 0 {
+		next = next.Add(time.Duration(syncJitter.Int63n(int64(config.SyncJitter))))
+	}
+	return next
+}
+
+func runScheduledSync() {
+	syncStatusLock.Lock()
+	if syncStatus.Running {
+		syncStatusLock.Unlock()
+		logger.Warnf("previous sync is still running, skip this run")
+		return
+	}
+	syncStatus.Running = true
+	syncStatusLock.Unlock()
+
+	logger.Infof("scheduled sync started")
+	ctx, span := trace.Start(context.Background(), "scheduled sync", oteltrace.SpanKindInternal)
+	run := &SyncRun{StartedAt: time.Now()}
+	// the error is kept if the run panics
+	err := fmt.Errorf("scheduled sync panicked")
+	// events are processed while the plan is built and applied, only its changes of the group tree hold them back
+	runTask(func() { err = scheduledSync(ctx, run) })
+	run.FinishedAt = time.Now()
+	trace.End(span, err)
+	if err != nil {
+		run.Error = err.Error()
+		if run.Status == "" {
+			run.Status = syncRunFailed
+		}
+		logger.Errorf("scheduled sync %v after %v, changes: %v, error: %v", run.Status, run.FinishedAt.Sub(run.StartedAt), run.Changes, err)
+	} else {
+		run.Status = syncRunSucceeded
+		logger.Infof("scheduled sync succeeded after %v, changes: %v", run.FinishedAt.Sub(run.StartedAt), run.Changes)
+	}
+
+	syncStatusLock.Lock()
+	syncStatus.Running = false
+	syncStatus.LastRun = run
+	syncStatusLock.Unlock()
+}
+
+func scheduledSync(ctx context.Context, run *SyncRun) error {
+	plan, err := BuildPlan(ctx)
+	if err != nil {
+		return err
+	}
+	run.Changes = len(plan.Changes)
+
+	if config.SyncMaxChanges > 0 && len(plan.Changes) > config.SyncMaxChanges {
+		run.Status = syncRunAborted
+		return fmt.Errorf("plan has %v changes, more than SYNC_MAX_CHANGES %v, nothing applied. Review it with the sync command in dry-run mode",
+			len(plan.Changes), config.SyncMaxChanges)
+	}
+	if err = plan.checkDeletions(); err != nil {
+		run.Status = syncRunAborted
+		return err
+	}
+	return ApplyPlan(ctx, plan, false)
+}
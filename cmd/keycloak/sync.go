@@ -0,0 +1,1009 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"keycloak-lark-adapter/cmd/lark"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syncState holds the desired state read from lark and the actual state read from keycloak
+type syncState struct {
+	// lark departments sorted parents first
+	deps      []*lm.DepartmentDetail
+	depsById  map[string]*lm.DepartmentDetail
+	depPaths  map[string]string
+	larkUsers []*lm.UserObject
+	// lark open id -> lark user, including the users out of scope
+	larkUsersById map[string]*lm.UserObject
+	// lark users out of the scope filters, they are not synchronized
+	outOfScopeUsers []*lm.UserObject
+	outOfScope      map[string]bool
+	// open department ids of the departments out of scope, their groups are left alone
+	outOfScopeDeps map[string]bool
+
+	groups []*keycloak.GroupInfo
+	// lark open department id -> bound keycloak group
+	groupsByDep map[string]*keycloak.GroupInfo
+	// keycloak group id -> parent group, nil for first class groups
+	groupParents map[string]*keycloak.GroupInfo
+	users        []*keycloak.User
+	// lark user id -> keycloak user linked to it by KEYCLOAK_IDP_ALIAS, nil if users are not matched by federated link
+	federatedLinks federatedLinks
+	// lark open id -> keycloak user carrying it in the lark_open_id attribute
+	usersByOpenId map[string]*keycloak.User
+	// lower case usernames of the keycloak users and of the users planned to be created
+	usernames usernameOwners
+	// users DEPARTMENT_LEADER_ROLE is granted to
+	leaderRoleUsers []*keycloak.User
+	// keycloak user id -> ids of the bound groups the user is a member of
+	memberships map[string]map[string]bool
+	// keycloak user ids of the members of the alumni group of offboarded users
+	alumniMembers map[string]bool
+}
+
+// Sync reconciles keycloak with lark: it computes the plan from the current state of both sides and applies it.
+// Running it again without changes in lark results in an empty plan.
+func Sync(ctx context.Context) error {
+	plan, err := BuildPlan(ctx)
+	if err != nil {
+		return err
+	}
+	return ApplyPlan(ctx, plan, false)
+}
+
+// BuildPlan computes the changes which bring keycloak in line with lark, nothing is written to keycloak
+func BuildPlan(ctx context.Context) (*Plan, error) {
+	logger := log.FromContext(ctx)
+	token, err := getAppToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fetchedAt := time.Now()
+	state, err := loadSyncState(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := newPlan()
+	plan.fetchedAt = fetchedAt
+	for depId, group := range state.groupsByDep {
+		plan.groupIds[depId] = group.ID
+	}
+	plan.managed = len(state.groupsByDep) + len(state.usersByOpenId)
+	planGroups(plan, state)
+	if err = planUsers(ctx, token, plan, state); err != nil {
+		return nil, err
+	}
+	planLeaderRole(plan, state)
+	plan.sort()
+
+	logger.Infof("sync plan computed with %v changes from %v departments and %v users in lark", len(plan.Changes), len(state.deps), len(state.larkUsers))
+	return plan, nil
+}
+
+// ApplyPlan applies the changes in order. A failed change is logged and skipped, changes depending on it fail as well.
+// Plans removing more groups and users than SYNC_MAX_DELETIONS allows are refused unless force is set. Once every
+// change succeeded, the fetch time of the plan is recorded as the floor of event versions.
+func ApplyPlan(ctx context.Context, plan *Plan, force bool) error {
+	logger := log.FromContext(ctx)
+	if !force {
+		if err := plan.checkDeletions(); err != nil {
+			return err
+		}
+	}
+
+	s := &applyState{
+		groupIds: make(map[string]string, len(plan.groupIds)),
+		userIds:  make(map[string]string, len(plan.userIds)),
+	}
+	for k, v := range plan.groupIds {
+		s.groupIds[k] = v
+	}
+	for k, v := range plan.userIds {
+		s.userIds[k] = v
+	}
+
+	var failed int
+	for _, change := range plan.Changes {
+		// events are processed while the plan is applied, the change would roll back the newer state of an event
+		if appliedSince(changeEntity(change.Op), change.LarkId, plan.fetchedAt) {
+			logger.Infof("skip %v %v, an event newer than the plan has been applied", change.Op, change.Target)
+			continue
+		}
+		logger.Infof("applying %v %v", change.Op, change.Target)
+		if err := applyChange(ctx, s, change); err != nil {
+			logger.Errorf("apply %v %v failed, error: %v", change.Op, change.Target, err.Error())
+			failed++
+		}
+	}
+
+	logger.Infof("sync plan applied, %v changes succeeded, %v failed", len(plan.Changes)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%v of %v changes failed", failed, len(plan.Changes))
+	}
+	// keycloak is in line with lark as of fetchedAt, events created before are stale from now on
+	if !plan.fetchedAt.IsZero() {
+		return recordEventVersionFloor(ctx, plan.fetchedAt.UnixNano()/int64(time.Millisecond))
+	}
+	return nil
+}
+
+// applyChange applies the change, changes of the group tree wait for the events in progress and hold back the
+// events after them like the department events changing the tree, see isBarrierDepEvent
+func applyChange(ctx context.Context, s *applyState, change *Change) error {
+	if eventPool == nil || !isGroupTreeChange(change.Op) {
+		return change.apply(ctx, s)
+	}
+	// the error is kept if the change panics
+	err := fmt.Errorf("apply %v %v panicked", change.Op, change.Target)
+	eventPool.barrier(func() { err = change.apply(ctx, s) })
+	return err
+}
+
+func loadSyncState(ctx context.Context, token string) (state *syncState, err error) {
+	state = &syncState{
+		depsById:       map[string]*lm.DepartmentDetail{},
+		groupsByDep:    map[string]*keycloak.GroupInfo{},
+		groupParents:   map[string]*keycloak.GroupInfo{},
+		memberships:    map[string]map[string]bool{},
+		alumniMembers:  map[string]bool{},
+		larkUsersById:  map[string]*lm.UserObject{},
+		usersByOpenId:  map[string]*keycloak.User{},
+		outOfScope:     map[string]bool{},
+		outOfScopeDeps: map[string]bool{},
+		usernames:      usernameOwners{},
+	}
+
+	state.deps, err = lark.ListDepartments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state.depPaths = lark.DepartmentPaths(state.deps)
+	sort.SliceStable(state.deps, func(i, j int) bool {
+		return strings.Count(state.depPaths[state.deps[i].OpenDepartmentID], "/") < strings.Count(state.depPaths[state.deps[j].OpenDepartmentID], "/")
+	})
+	depIds := []string{lark.RootDepartmentId}
+	for _, dep := range state.deps {
+		state.depsById[dep.OpenDepartmentID] = dep
+		depIds = append(depIds, dep.OpenDepartmentID)
+	}
+
+	state.larkUsers, err = lark.ListUsers(ctx, depIds)
+	if err != nil {
+		return nil, err
+	}
+	for _, userObj := range state.larkUsers {
+		fillEmail(userObj)
+		state.larkUsersById[userObj.OpenID] = userObj
+	}
+	if err = state.applyScope(); err != nil {
+		return nil, err
+	}
+
+	state.groups, err = getGroups(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	var f func(parent *keycloak.GroupInfo, groups []*keycloak.GroupInfo)
+	f = func(parent *keycloak.GroupInfo, groups []*keycloak.GroupInfo) {
+		for _, group := range groups {
+			state.groupParents[group.ID] = parent
+			// archived groups and their subgroups are not bound any more
+			if isArchivedGroup(group) {
+				continue
+			}
+			if depId := group.GetAttribute(attributeLarkOpenDepartmentId); depId != "" {
+				state.groupsByDep[depId] = group
+			}
+			f(group, group.SubGroups)
+		}
+	}
+	f(nil, state.groups)
+
+	state.users, err = getUserList(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	state.federatedLinks, err = indexFederatedLinks(ctx, token, state.users)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range state.users {
+		if openId := user.GetAttribute(attributeLarkOpenId); openId != "" {
+			state.usersByOpenId[openId] = user
+		}
+		state.usernames.add(user.Username, user.GetAttribute(attributeLarkOpenId))
+	}
+	if config.DepartmentLeaderRole != "" {
+		state.leaderRoleUsers, err = getRoleUsers(ctx, token, config.DepartmentLeaderRole)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, group := range state.groupsByDep {
+		members, err := getGroupMembers(ctx, token, group.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			if state.memberships[member.Id] == nil {
+				state.memberships[member.Id] = map[string]bool{}
+			}
+			state.memberships[member.Id][group.ID] = true
+		}
+	}
+	if hasOffboardAction(offboardMoveAlumni) {
+		alumniPath := "/" + strings.Trim(config.OffboardAlumniGroup, "/")
+		var alumniGroup *keycloak.GroupInfo
+		walkGroups(state.groups, func(group *keycloak.GroupInfo) bool {
+			if group.Path == alumniPath {
+				alumniGroup = group
+				return false
+			}
+			return true
+		})
+		if alumniGroup != nil {
+			members, err := getGroupMembers(ctx, token, alumniGroup.ID)
+			if err != nil {
+				return nil, err
+			}
+			for _, member := range members {
+				state.alumniMembers[member.Id] = true
+			}
+		}
+	}
+
+	return state, nil
+}
+
+// applyScope drops the departments and users out of the scope filters, the groups of departments out of scope are
+// left alone and users out of scope are handled by OUT_OF_SCOPE_ACTION
+func (s *syncState) applyScope() error {
+	inScopeDeps := map[string]bool{}
+	lookup := func(depId string) (*lm.DepartmentDetail, error) {
+		return s.depsById[depId], nil
+	}
+	var deps []*lm.DepartmentDetail
+	for _, dep := range s.deps {
+		ok, err := depInScope(dep.OpenDepartmentID, lookup)
+		if err != nil {
+			return err
+		}
+		if ok {
+			inScopeDeps[dep.OpenDepartmentID] = true
+			deps = append(deps, dep)
+		} else {
+			s.outOfScopeDeps[dep.OpenDepartmentID] = true
+		}
+	}
+	// the departments out of scope are removed only now, the subdepartments need their ancestors to resolve the scope
+	for depId := range s.outOfScopeDeps {
+		delete(s.depsById, depId)
+	}
+	s.deps = deps
+
+	var users []*lm.UserObject
+	for _, userObj := range s.larkUsers {
+		ok, err := userInScope(userObj, func(depId string) (bool, error) {
+			return inScopeDeps[depId], nil
+		})
+		if err != nil {
+			return err
+		}
+		if ok {
+			users = append(users, userObj)
+		} else {
+			s.outOfScopeUsers = append(s.outOfScopeUsers, userObj)
+			s.outOfScope[userObj.OpenID] = true
+		}
+	}
+	s.larkUsers = users
+	return nil
+}
+
+// leaderValue returns the value of the leader and manager attributes for the lark user, see leaderValue
+func (s *syncState) leaderValue(openId string) string {
+	if config.LeaderAttributeFormat == leaderFormatId {
+		if user := s.usersByOpenId[openId]; user != nil {
+			return user.Id
+		}
+		return ""
+	}
+	if userObj := s.larkUsersById[openId]; userObj != nil {
+		return userObj.Email
+	}
+	return ""
+}
+
+// parentPath returns the path of the parent group, "/" for first class groups
+func (s *syncState) parentPath(group *keycloak.GroupInfo) string {
+	if parent := s.groupParents[group.ID]; parent != nil {
+		return parent.Path
+	}
+	return "/"
+}
+
+// parentDepId returns the parent of the department, departments whose parent is not visible to the lark app
+// are treated as first class departments
+func (state *syncState) parentDepId(dep *lm.DepartmentDetail) string {
+	if _, ok := state.depsById[dep.ParentDepartmentID]; ok {
+		return dep.ParentDepartmentID
+	}
+	return lark.RootDepartmentId
+}
+
+// depPath returns the keycloak path of the group of the department
+func (state *syncState) depPath(depId string) string {
+	if depId == lark.RootDepartmentId {
+		return rootPath()
+	}
+	return larkGroupPath(state.depPaths[depId])
+}
+
+func planGroups(plan *Plan, state *syncState) {
+	for _, dep := range state.deps {
+		dep := dep
+		parentDepId := state.parentDepId(dep)
+		group := state.groupsByDep[dep.OpenDepartmentID]
+
+		if group == nil {
+			plan.add(&Change{
+				Op:     opCreateGroup,
+				Target: state.depPath(dep.OpenDepartmentID),
+				LarkId: dep.OpenDepartmentID,
+				Diffs:  diffField(nil, "parent", "", state.depPath(parentDepId)),
+				apply: func(ctx context.Context, s *applyState) error {
+					token, err := s.getToken(ctx)
+					if err != nil {
+						return err
+					}
+					parentGroupId, err := s.getGroupId(ctx, parentDepId)
+					if err != nil {
+						return err
+					}
+					groupId, err := createGroupForDep(ctx, token, dep, state.depPaths[dep.OpenDepartmentID], parentGroupId)
+					if err != nil {
+						return err
+					}
+					s.groupIds[dep.OpenDepartmentID] = groupId
+					return nil
+				},
+			})
+			continue
+		}
+
+		desired := genGroup4Create(dep, state.depPaths[dep.OpenDepartmentID])
+		leader := state.leaderValue(dep.LeaderUserID)
+		setGroupLeader(desired, dep.LeaderUserID, leader)
+		var diffs []*FieldDiff
+		diffs = diffField(diffs, "name", group.Name, desired.Name)
+		diffs = depAttributeDiffs(diffs, group, desired, attributeLarkLeaderOpenId, attributeLeader)
+		if len(diffs) > 0 {
+			updated := *group
+			updated.Name = desired.Name
+			updated.Attributes = map[string]interface{}{}
+			for key, value := range group.Attributes {
+				updated.Attributes[key] = value
+			}
+			setDepAttributes(&updated, dep, state.depPaths[dep.OpenDepartmentID])
+			setGroupLeader(&updated, dep.LeaderUserID, leader)
+			plan.add(&Change{
+				Op:         opUpdateGroup,
+				Target:     group.Path,
+				LarkId:     dep.OpenDepartmentID,
+				KeycloakId: group.ID,
+				Diffs:      diffs,
+				apply: func(ctx context.Context, s *applyState) error {
+					token, err := s.getToken(ctx)
+					if err != nil {
+						return err
+					}
+					return groupNameUpdateEngine(ctx, token, &updated)
+				},
+			})
+		}
+
+		actualParentDepId := lark.RootDepartmentId
+		if parent := state.groupParents[group.ID]; !isRootParent(parent) {
+			// a parent which is not bound to a department never matches, neither do first class groups if
+			// KEYCLOAK_ROOT_GROUP is set
+			actualParentDepId = ""
+			if parent != nil {
+				actualParentDepId = parent.GetAttribute(attributeLarkOpenDepartmentId)
+			}
+		}
+		if actualParentDepId != parentDepId {
+			plan.add(&Change{
+				Op:         opMoveGroup,
+				Target:     group.Path,
+				LarkId:     dep.OpenDepartmentID,
+				KeycloakId: group.ID,
+				Diffs:      diffField(nil, "parent", state.parentPath(group), state.depPath(parentDepId)),
+				apply: func(ctx context.Context, s *applyState) error {
+					token, err := s.getToken(ctx)
+					if err != nil {
+						return err
+					}
+					parentGroupId, err := s.getGroupId(ctx, parentDepId)
+					if err != nil {
+						return err
+					}
+					return groupParentUpdateEngine(ctx, token, group.ID, parentGroupId)
+				},
+			})
+		}
+	}
+
+	// groups of departments deleted in lark, children are deleted before their parents
+	var deleted []*keycloak.GroupInfo
+	for depId, group := range state.groupsByDep {
+		if _, ok := state.depsById[depId]; !ok && !state.outOfScopeDeps[depId] {
+			deleted = append(deleted, group)
+		}
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		return strings.Count(deleted[i].Path, "/") > strings.Count(deleted[j].Path, "/")
+	})
+	for _, group := range deleted {
+		group := group
+		change := &Change{
+			Op:         opDeleteGroup,
+			Target:     group.Path,
+			LarkId:     group.GetAttribute(attributeLarkOpenDepartmentId),
+			KeycloakId: group.ID,
+			apply: func(ctx context.Context, s *applyState) error {
+				token, err := s.getToken(ctx)
+				if err != nil {
+					return err
+				}
+				return removeGroupOfDep(ctx, token, group.ID)
+			},
+		}
+		switch config.DepartmentDeletePolicy {
+		case depDeletePolicyArchive:
+			change.Op = opArchiveGroup
+			change.Diffs = diffField(nil, "parent", state.parentPath(group), config.DepartmentArchiveGroup)
+		case depDeletePolicyRefuse:
+			change.Reason = "refused if members or subgroups remain"
+		}
+		plan.add(change)
+	}
+}
+
+func planUsers(ctx context.Context, token string, plan *Plan, state *syncState) error {
+	logger := log.FromContext(ctx)
+	matched := map[string]bool{}
+	for _, userObj := range state.larkUsers {
+		userObj := userObj
+		user, err := matchUser(ctx, token, state.users, state.federatedLinks, userObj)
+		if err != nil {
+			return err
+		}
+		if user != nil {
+			matched[user.Id] = true
+			plan.userIds[userObj.OpenID] = user.Id
+		}
+
+		if reason := getOffboardReason(userObj); reason != "" {
+			if user != nil {
+				planOffboardUser(plan, state, user, reason)
+			}
+			continue
+		}
+
+		if user == nil {
+			if baseUsername(userObj) == "" {
+				logger.Warnf("user %v has neither email nor username in lark, skip creating it", describeUser(userObj))
+				continue
+			}
+			planCreateUser(plan, state, userObj, state.leaderValue(userObj.LeaderUserID))
+		} else {
+			planUpdateUser(plan, user, userObj, state.leaderValue(userObj.LeaderUserID))
+		}
+		planMemberships(plan, state, user, userObj)
+		if err = planRoleRules(ctx, token, plan, state, user, userObj); err != nil {
+			return err
+		}
+	}
+
+	// users out of scope are not synchronized, their keycloak users are left untouched unless OUT_OF_SCOPE_ACTION
+	// is offboard
+	for _, userObj := range state.outOfScopeUsers {
+		user, err := matchUser(ctx, token, state.users, state.federatedLinks, userObj)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			continue
+		}
+		matched[user.Id] = true
+		if config.OutOfScopeAction == outOfScopeOffboard {
+			planOffboardUser(plan, state, user, offboardReasonOutOfScope)
+		}
+	}
+
+	// users created from lark which are no longer visible in lark
+	for _, user := range state.users {
+		if user.GetAttribute(attributeLarkOpenId) != "" && !matched[user.Id] {
+			planOffboardUser(plan, state, user, offboardReasonNotFound)
+		}
+	}
+	return nil
+}
+
+func planCreateUser(plan *Plan, state *syncState, userObj *lm.UserObject, manager string) {
+	user := genUser4Create(userObj)
+	// users created by the same plan must not collide either
+	user.Username = pickUsernameFrom(userObj, state.usernames)
+	state.usernames.add(user.Username, userObj.OpenID)
+	setUserManager(user.Attributes, userObj.LeaderUserID, manager)
+	enabled := isUserEnabled(userObj)
+	user.Enabled = &enabled
+
+	diffs := diffField(nil, "username", "", user.Username)
+	diffs = diffField(diffs, "email", "", user.Email)
+	diffs = diffField(diffs, "firstName", "", user.FirstName)
+	diffs = diffField(diffs, "lastName", "", user.LastName)
+	diffs = diffField(diffs, "enabled", "", strconv.FormatBool(enabled))
+	for _, key := range sortedAttributeKeys(user.Attributes) {
+		diffs = diffField(diffs, "attributes."+key, "", keycloak.AttributeValue(user.Attributes, key))
+	}
+
+	plan.add(&Change{
+		Op:     opCreateUser,
+		Target: user.Username,
+		LarkId: userObj.OpenID,
+		Diffs:  diffs,
+		apply: func(ctx context.Context, s *applyState) error {
+			token, err := s.getToken(ctx)
+			if err != nil {
+				return err
+			}
+			userId, err := createUser(ctx, token, user)
+			if err != nil {
+				return err
+			}
+			s.userIds[userObj.OpenID] = userId
+			return unparkUser(userObj.OpenID)
+		},
+	})
+}
+
+func planUpdateUser(plan *Plan, user *keycloak.User, userObj *lm.UserObject, manager string) {
+	updated, diffs := genUser4Sync(user, userObj, manager)
+	pending := isPendingDeletion(user.Id)
+	if pending {
+		diffs = diffField(diffs, "scheduled_deletion", "true", "false")
+	}
+	if len(diffs) == 0 {
+		return
+	}
+
+	plan.add(&Change{
+		Op:         opUpdateUser,
+		Target:     user.Username,
+		LarkId:     userObj.OpenID,
+		KeycloakId: user.Id,
+		Diffs:      diffs,
+		apply: func(ctx context.Context, s *applyState) error {
+			token, err := s.getToken(ctx)
+			if err != nil {
+				return err
+			}
+			if !strings.EqualFold(user.Email, updated.Email) {
+				if err = checkUserConflict(ctx, token, updated); err != nil {
+					return err
+				}
+			}
+			if err = updateUser(ctx, token, updated.Id, updated); err != nil {
+				return err
+			}
+			if pending {
+				return cancelPendingDeletion(updated.Id)
+			}
+			return nil
+		},
+	})
+}
+
+// planOffboardUser applies the offboarding policy to the user, nothing is planned if the user is already offboarded
+func planOffboardUser(plan *Plan, state *syncState, user *keycloak.User, reason string) {
+	apply := func(ctx context.Context, s *applyState) error {
+		token, err := s.getToken(ctx)
+		if err != nil {
+			return err
+		}
+		return offboardUser(ctx, token, user, reason)
+	}
+	if deletesImmediately(reason) {
+		plan.add(&Change{
+			Op:         opDeleteUser,
+			Target:     user.Username,
+			LarkId:     user.GetAttribute(attributeLarkOpenId),
+			KeycloakId: user.Id,
+			Reason:     reason,
+			apply:      apply,
+		})
+		return
+	}
+
+	updated, _ := genUser4Offboard(user, reason)
+	diffs := diffField(nil, "enabled", strconv.FormatBool(user.Enabled == nil || *user.Enabled), strconv.FormatBool(updated.Enabled == nil || *updated.Enabled))
+	diffs = diffField(diffs, "attributes."+attributeDisabledReason, user.GetAttribute(attributeDisabledReason), updated.GetAttribute(attributeDisabledReason))
+	if hasOffboardAction(offboardRemoveGroups) {
+		depIds := map[string]bool{}
+		for depId := range state.groupsByDep {
+			depIds[depId] = true
+		}
+		for _, depId := range sortedKeys(depIds) {
+			if group := state.groupsByDep[depId]; state.memberships[user.Id][group.ID] {
+				diffs = diffField(diffs, "group", group.Path, "")
+			}
+		}
+	}
+	if hasOffboardAction(offboardMoveAlumni) && !state.alumniMembers[user.Id] {
+		diffs = diffField(diffs, "group", "", config.OffboardAlumniGroup)
+	}
+	if isDeletable(reason) && !isPendingDeletion(user.Id) {
+		diffs = diffField(diffs, "delete_after", "", config.OffboardDeleteAfter.String())
+	}
+	if len(diffs) == 0 {
+		return
+	}
+
+	plan.add(&Change{
+		Op:         opOffboardUser,
+		Target:     user.Username,
+		LarkId:     user.GetAttribute(attributeLarkOpenId),
+		KeycloakId: user.Id,
+		Reason:     reason,
+		Diffs:      diffs,
+		apply:      apply,
+	})
+}
+
+// planLeaderRole grants DEPARTMENT_LEADER_ROLE to the leaders of lark departments and revokes it from users
+// who do not lead any department. The role is revoked only if it is granted by the adapter, see
+// attributeLeaderRoleGranted, users the role is granted to manually are left untouched.
+func planLeaderRole(plan *Plan, state *syncState) {
+	if config.DepartmentLeaderRole == "" {
+		return
+	}
+
+	leaders := map[string]bool{}
+	for _, dep := range state.deps {
+		userObj := state.larkUsersById[dep.LeaderUserID]
+		if userObj == nil || getOffboardReason(userObj) != "" || state.outOfScope[userObj.OpenID] {
+			continue
+		}
+		// leaders without email and username are neither created nor matched
+		if _, ok := plan.userIds[userObj.OpenID]; ok || baseUsername(userObj) != "" {
+			leaders[userObj.OpenID] = true
+		}
+	}
+
+	holders := map[string]bool{}
+	for _, user := range state.leaderRoleUsers {
+		openId := user.GetAttribute(attributeLarkOpenId)
+		if openId == "" {
+			continue
+		}
+		holders[openId] = true
+		// the users of the role may come in brief representation, the attributes are read from the full listing
+		if synced := state.usersByOpenId[openId]; synced != nil {
+			user = synced
+		}
+		if leaders[openId] || state.outOfScope[openId] || user.GetAttribute(attributeLeaderRoleGranted) == "" {
+			continue
+		}
+		user := user
+		plan.add(&Change{
+			Op:         opRevokeRole,
+			Target:     user.Username,
+			LarkId:     openId,
+			KeycloakId: user.Id,
+			Reason:     "not a department leader in lark",
+			Diffs:      diffField(nil, "realm_role", config.DepartmentLeaderRole, ""),
+			apply: func(ctx context.Context, s *applyState) error {
+				token, err := s.getToken(ctx)
+				if err != nil {
+					return err
+				}
+				return revokeLeaderRoleFromUser(ctx, token, user.Id)
+			},
+		})
+	}
+
+	for _, openId := range sortedKeys(leaders) {
+		if holders[openId] {
+			continue
+		}
+		openId := openId
+		plan.add(&Change{
+			Op:         opGrantRole,
+			Target:     describeUser(state.larkUsersById[openId]),
+			LarkId:     openId,
+			KeycloakId: plan.userIds[openId],
+			Reason:     "department leader in lark",
+			Diffs:      diffField(nil, "realm_role", "", config.DepartmentLeaderRole),
+			apply: func(ctx context.Context, s *applyState) error {
+				token, err := s.getToken(ctx)
+				if err != nil {
+					return err
+				}
+				userId, err := s.getUserId(openId)
+				if err != nil {
+					return err
+				}
+				return grantLeaderRoleToUser(ctx, token, userId)
+			},
+		})
+	}
+}
+
+// planRoleRules grants the roles of matching role rules and revokes the roles granted by rules which no longer match
+func planRoleRules(ctx context.Context, token string, plan *Plan, state *syncState, user *keycloak.User, userObj *lm.UserObject) error {
+	if len(roleRules) == 0 {
+		return nil
+	}
+
+	var depPaths []string
+	for _, depId := range getUserDepIds(userObj) {
+		if path, ok := state.depPaths[depId]; ok {
+			depPaths = append(depPaths, path)
+		}
+	}
+	actual, tracked := map[string]bool{}, map[string]bool{}
+	target := describeUser(userObj)
+	if user != nil {
+		var err error
+		if actual, err = userRoleSpecs(ctx, token, user.Id); err != nil {
+			return err
+		}
+		tracked = trackedRuleRoles(user)
+		target = user.Username
+	}
+
+	grant, revoke := ruleRoleChanges(desiredRuleRoles(userObj, depPaths), actual, tracked)
+	if len(grant) > 0 {
+		plan.add(ruleRoleChange(opGrantRole, target, userObj.OpenID, grant, nil))
+	}
+	if len(revoke) > 0 {
+		plan.add(ruleRoleChange(opRevokeRole, target, userObj.OpenID, nil, revoke))
+	}
+	return nil
+}
+
+func ruleRoleChange(op, target, openId string, grant, revoke []string) *Change {
+	var diffs []*FieldDiff
+	for _, role := range grant {
+		diffs = diffField(diffs, "role", "", role)
+	}
+	for _, role := range revoke {
+		diffs = diffField(diffs, "role", role, "")
+	}
+	return &Change{
+		Op:     op,
+		Target: target,
+		LarkId: openId,
+		Reason: "role rules",
+		Diffs:  diffs,
+		apply: func(ctx context.Context, s *applyState) error {
+			token, err := s.getToken(ctx)
+			if err != nil {
+				return err
+			}
+			userId, err := s.getUserId(openId)
+			if err != nil {
+				return err
+			}
+			return updateRuleRoles(ctx, token, userId, grant, revoke)
+		},
+	}
+}
+
+// planMemberships adds and removes memberships of groups bound to departments, other groups are left untouched
+func planMemberships(plan *Plan, state *syncState, user *keycloak.User, userObj *lm.UserObject) {
+	target := describeUser(userObj)
+	desired := map[string]bool{}
+	for _, depId := range getUserDepIds(userObj) {
+		if _, ok := state.depsById[depId]; ok {
+			desired[depId] = true
+		}
+	}
+
+	actual := map[string]bool{}
+	if user != nil {
+		target = user.Username
+		for groupId := range state.memberships[user.Id] {
+			for depId, group := range state.groupsByDep {
+				if group.ID == groupId {
+					actual[depId] = true
+				}
+			}
+		}
+	}
+
+	for _, depId := range sortedKeys(desired) {
+		if actual[depId] {
+			continue
+		}
+		depId := depId
+		plan.add(&Change{
+			Op:     opAddMembership,
+			Target: target,
+			LarkId: userObj.OpenID,
+			Diffs:  diffField(nil, "group", "", state.depPath(depId)),
+			apply: func(ctx context.Context, s *applyState) error {
+				token, err := s.getToken(ctx)
+				if err != nil {
+					return err
+				}
+				userId, err := s.getUserId(userObj.OpenID)
+				if err != nil {
+					return err
+				}
+				groupId, err := s.getGroupId(ctx, depId)
+				if err != nil {
+					return err
+				}
+				return userGroupAddEngine(ctx, token, userId, groupId)
+			},
+		})
+	}
+
+	for _, depId := range sortedKeys(actual) {
+		// memberships of deleted departments are dropped together with their groups
+		if _, ok := state.depsById[depId]; desired[depId] || !ok {
+			continue
+		}
+		group := state.groupsByDep[depId]
+		plan.add(&Change{
+			Op:         opRemoveMembership,
+			Target:     target,
+			LarkId:     userObj.OpenID,
+			KeycloakId: user.Id,
+			Diffs:      diffField(nil, "group", group.Path, ""),
+			apply: func(ctx context.Context, s *applyState) error {
+				token, err := s.getToken(ctx)
+				if err != nil {
+					return err
+				}
+				return userGroupDeleteEngine(ctx, token, user.Id, group.ID)
+			},
+		})
+	}
+}
+
+// genUser4Sync applies the lark user to a copy of the keycloak user the same way genUser4Create builds a new user,
+// the username is never changed. Returns the updated user and the changed fields.
+func genUser4Sync(user *keycloak.User, userObj *lm.UserObject, manager string) (updated *keycloak.User, diffs []*FieldDiff) {
+	desired := genUser4Create(userObj)
+	setUserManager(desired.Attributes, userObj.LeaderUserID, manager)
+	enabled := isUserEnabled(userObj)
+	// 只重新启用adapter禁用的用户，在keycloak中手工禁用的用户保持禁用
+	adapterDisabled := isAdapterDisabled(user)
+	if user.Enabled != nil && !*user.Enabled && !adapterDisabled {
+		enabled = false
+	}
+
+	updated = new(keycloak.User)
+	*updated = *user
+	updated.Attributes = map[string]interface{}{}
+	for key, value := range user.Attributes {
+		updated.Attributes[key] = value
+	}
+
+	if !strings.EqualFold(user.Email, desired.Email) {
+		diffs = diffField(diffs, "email", user.Email, desired.Email)
+		updated.Email = desired.Email
+	}
+	diffs = diffField(diffs, "firstName", user.FirstName, desired.FirstName)
+	updated.FirstName = desired.FirstName
+	diffs = diffField(diffs, "lastName", user.LastName, desired.LastName)
+	updated.LastName = desired.LastName
+	if user.Enabled == nil || *user.Enabled != enabled {
+		diffs = diffField(diffs, "enabled", strconv.FormatBool(!enabled), strconv.FormatBool(enabled))
+		updated.Enabled = &enabled
+	}
+	for _, key := range withKeys(sortedAttributeKeys(desired.Attributes), append(mappedAttributeKeys(), attributeLarkManagerOpenId, attributeManager, attributeLarkEmailSource, attributeLarkPrimaryDepartmentId)...) {
+		value := keycloak.AttributeValue(desired.Attributes, key)
+		if old := user.GetAttribute(key); old != value {
+			diffs = diffField(diffs, "attributes."+key, old, value)
+			if value == "" {
+				delete(updated.Attributes, key)
+			} else {
+				updated.Attributes[key] = value
+			}
+		}
+	}
+	if adapterDisabled && enabled {
+		for _, key := range []string{attributeDisabledReason, attributeDisabledAt} {
+			if old := user.GetAttribute(key); old != "" {
+				diffs = diffField(diffs, "attributes."+key, old, "")
+			}
+		}
+		clearOffboarding(updated.Attributes)
+	}
+	return updated, diffs
+}
+
+// isUserEnabled 飞书中冻结的用户在keycloak中禁用
+func isUserEnabled(userObj *lm.UserObject) bool {
+	return userObj.Status == nil || !userObj.Status.IsFrozen
+}
+
+func (s *applyState) getGroupId(ctx context.Context, depId string) (string, error) {
+	if depId == lark.RootDepartmentId {
+		if groupId, ok := s.groupIds[depId]; ok {
+			return groupId, nil
+		}
+		token, err := s.getToken(ctx)
+		if err != nil {
+			return "", err
+		}
+		groupId, err := rootGroupId(ctx, token)
+		if err != nil {
+			return "", err
+		}
+		s.groupIds[depId] = groupId
+		return groupId, nil
+	}
+	groupId, ok := s.groupIds[depId]
+	if !ok {
+		return "", fmt.Errorf("group of department %v does not exist in keycloak", depId)
+	}
+	return groupId, nil
+}
+
+func (s *applyState) getUserId(openId string) (string, error) {
+	userId, ok := s.userIds[openId]
+	if !ok {
+		return "", errors.New("user " + openId + " does not exist in keycloak")
+	}
+	return userId, nil
+}
+
+// withKeys appends the keys missing in keys, so that attributes which are no longer desired are diffed as well
+func withKeys(keys []string, extra ...string) []string {
+	for _, key := range extra {
+		found := false
+		for _, item := range keys {
+			found = found || item == key
+		}
+		if !found {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// sortedAttributeKeys returns the attribute names in order
+func sortedAttributeKeys(attrs map[string]interface{}) []string {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedKeys returns the keys of the set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,311 @@
+package keycloak
+
+import (
+	"context"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"keycloak-lark-adapter/internal/store"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testSyncState builds the sync state of the lark departments, sorted parents first, and the keycloak groups bound to
+// them. Parents of the groups are resolved by path.
+func testSyncState(deps []*lm.DepartmentDetail, groups []*keycloak.GroupInfo) *syncState {
+	state := &syncState{
+		deps:           deps,
+		depsById:       map[string]*lm.DepartmentDetail{},
+		depPaths:       map[string]string{},
+		larkUsersById:  map[string]*lm.UserObject{},
+		outOfScopeDeps: map[string]bool{},
+		groups:         groups,
+		groupsByDep:    map[string]*keycloak.GroupInfo{},
+		groupParents:   map[string]*keycloak.GroupInfo{},
+		usersByOpenId:  map[string]*keycloak.User{},
+	}
+	for _, dep := range deps {
+		state.depsById[dep.OpenDepartmentID] = dep
+		state.depPaths[dep.OpenDepartmentID] = state.depPaths[dep.ParentDepartmentID] + "/" + dep.Name
+	}
+	groupsByPath := map[string]*keycloak.GroupInfo{}
+	for _, group := range groups {
+		state.groupsByDep[group.GetAttribute(attributeLarkOpenDepartmentId)] = group
+		groupsByPath[group.Path] = group
+	}
+	for _, group := range groups {
+		if i := strings.LastIndex(group.Path, "/"); i > 0 {
+			state.groupParents[group.ID] = groupsByPath[group.Path[:i]]
+		}
+	}
+	return state
+}
+
+func testDep(id, name, parentId string) *lm.DepartmentDetail {
+	return &lm.DepartmentDetail{OpenDepartmentID: id, Name: name, ParentDepartmentID: parentId}
+}
+
+// testGroup returns the group of the department as the adapter creates it
+func testGroup(id string, dep *lm.DepartmentDetail, path string) *keycloak.GroupInfo {
+	group := genGroup4Create(dep, path)
+	group.ID = id
+	group.Path = path
+	return group
+}
+
+// planOps returns the changes of the plan as "<op> <target>"
+func planOps(plan *Plan) []string {
+	var ops []string
+	for _, change := range plan.Changes {
+		ops = append(ops, change.Op+" "+change.Target)
+	}
+	return ops
+}
+
+func TestPlanGroups(t *testing.T) {
+	dev := testDep("od-dev", "Dev", "0")
+	qa := testDep("od-qa", "QA", "od-dev")
+	ops := testDep("od-ops", "Ops", "0")
+	gone := testDep("od-gone", "Gone", "0")
+
+	tests := []struct {
+		name   string
+		deps   []*lm.DepartmentDetail
+		groups []*keycloak.GroupInfo
+		// open department ids out of scope
+		outOfScope []string
+		policy     string
+		want       []string
+	}{
+		{
+			name: "creates groups of new departments",
+			deps: []*lm.DepartmentDetail{dev, qa},
+			want: []string{"create_group /Dev", "create_group /Dev/QA"},
+		},
+		{
+			name:   "leaves groups in line with lark alone",
+			deps:   []*lm.DepartmentDetail{dev, qa},
+			groups: []*keycloak.GroupInfo{testGroup("g-dev", dev, "/Dev"), testGroup("g-qa", qa, "/Dev/QA")},
+		},
+		{
+			name:   "renames groups of renamed departments",
+			deps:   []*lm.DepartmentDetail{testDep("od-dev", "Engineering", "0")},
+			groups: []*keycloak.GroupInfo{testGroup("g-dev", dev, "/Dev")},
+			want:   []string{"update_group /Dev"},
+		},
+		{
+			name:   "moves groups of moved departments",
+			deps:   []*lm.DepartmentDetail{dev, ops, testDep("od-qa", "QA", "od-ops")},
+			groups: []*keycloak.GroupInfo{testGroup("g-dev", dev, "/Dev"), testGroup("g-ops", ops, "/Ops"), testGroup("g-qa", qa, "/Dev/QA")},
+			want:   []string{"update_group /Dev/QA", "move_group /Dev/QA"},
+		},
+		{
+			name:   "deletes groups of deleted departments, children first",
+			deps:   []*lm.DepartmentDetail{ops},
+			groups: []*keycloak.GroupInfo{testGroup("g-dev", dev, "/Dev"), testGroup("g-ops", ops, "/Ops"), testGroup("g-qa", qa, "/Dev/QA")},
+			policy: depDeletePolicyDelete,
+			want:   []string{"delete_group /Dev/QA", "delete_group /Dev"},
+		},
+		{
+			name:   "archives groups of deleted departments",
+			groups: []*keycloak.GroupInfo{testGroup("g-gone", gone, "/Gone")},
+			policy: depDeletePolicyArchive,
+			want:   []string{"archive_group /Gone"},
+		},
+		{
+			name:       "leaves groups of departments out of scope alone",
+			deps:       []*lm.DepartmentDetail{dev},
+			groups:     []*keycloak.GroupInfo{testGroup("g-dev", dev, "/Dev"), testGroup("g-gone", gone, "/Gone")},
+			outOfScope: []string{"od-gone"},
+			policy:     depDeletePolicyDelete,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.DepartmentDeletePolicy = tt.policy
+			state := testSyncState(tt.deps, tt.groups)
+			for _, depId := range tt.outOfScope {
+				state.outOfScopeDeps[depId] = true
+			}
+			plan := newPlan()
+			planGroups(plan, state)
+			plan.sort()
+			if got := planOps(plan); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planGroups() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanCheckDeletions(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		percent   bool
+		managed   int
+		deletions int
+		wantErr   bool
+	}{
+		{name: "below count", limit: 5, managed: 100, deletions: 5},
+		{name: "above count", limit: 5, managed: 100, deletions: 6, wantErr: true},
+		{name: "below percentage", limit: 10, percent: true, managed: 200, deletions: 20},
+		{name: "above percentage", limit: 10, percent: true, managed: 200, deletions: 21, wantErr: true},
+		{name: "percentage of a small realm", limit: 10, percent: true, managed: 5, deletions: 1},
+		{name: "above percentage of a small realm", limit: 10, percent: true, managed: 5, deletions: 2, wantErr: true},
+		{name: "percentage rounded up", limit: 10, percent: true, managed: 201, deletions: 21},
+		{name: "unlimited", limit: -1, managed: 10, deletions: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.SyncMaxDeletions, config.SyncMaxDeletionsPercent = tt.limit, tt.percent
+			plan := newPlan()
+			plan.managed = tt.managed
+			plan.add(&Change{Op: opCreateGroup})
+			for i := 0; i < tt.deletions; i++ {
+				plan.add(&Change{Op: opOffboardUser})
+			}
+			if err := plan.checkDeletions(); (err != nil) != tt.wantErr {
+				t.Errorf("checkDeletions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if err := ApplyPlan(context.Background(), plan, false); err == nil {
+					t.Errorf("ApplyPlan() applied a plan over the limit")
+				}
+			}
+		})
+	}
+}
+
+func TestApplyScope(t *testing.T) {
+	dev := testDep("od-dev", "Dev", "0")
+	qa := testDep("od-qa", "QA", "od-dev")
+	sub := testDep("od-sub", "Sub", "od-qa")
+	ops := testDep("od-ops", "Ops", "0")
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{name: "no filters", want: []string{"od-dev", "od-qa", "od-sub", "od-ops"}},
+		{name: "excludes the subtree", exclude: []string{"/Dev/QA"}, want: []string{"od-dev", "od-ops"}},
+		{name: "excludes the subtree by id", exclude: []string{"od-dev"}, want: []string{"od-ops"}},
+		{name: "includes the subtree", include: []string{"/Dev/QA"}, want: []string{"od-qa", "od-sub"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.DepartmentInclude, config.DepartmentExclude = tt.include, tt.exclude
+			defer func() { config.DepartmentInclude, config.DepartmentExclude = nil, nil }()
+			state := testSyncState([]*lm.DepartmentDetail{dev, qa, sub, ops}, nil)
+			if err := state.applyScope(); err != nil {
+				t.Fatalf("applyScope() error = %v", err)
+			}
+			var got []string
+			for _, dep := range state.deps {
+				got = append(got, dep.OpenDepartmentID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("applyScope() deps = %v, want %v", got, tt.want)
+			}
+			for depId := range state.depsById {
+				if state.outOfScopeDeps[depId] {
+					t.Errorf("department %v out of scope is still looked up", depId)
+				}
+			}
+			if len(state.depsById) != len(tt.want) {
+				t.Errorf("applyScope() kept %v departments, want %v", len(state.depsById), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestGenUser4SyncEnabled(t *testing.T) {
+	config.NameStrategy = nameStrategyParenthesis
+	userObj := &lm.UserObject{OpenID: "ou-alice", Name: "Alice", Email: "alice@example.com", Status: &lm.UserStatus{}}
+	frozen := &lm.UserObject{OpenID: "ou-alice", Name: "Alice", Email: "alice@example.com", Status: &lm.UserStatus{IsFrozen: true}}
+
+	tests := []struct {
+		name        string
+		enabled     bool
+		reason      string
+		userObj     *lm.UserObject
+		wantEnabled bool
+		wantReason  string
+	}{
+		{name: "active user", enabled: true, userObj: userObj, wantEnabled: true},
+		{name: "disabled by the adapter", reason: offboardReasonFrozen, userObj: userObj, wantEnabled: true},
+		{name: "disabled manually", reason: "left the project", userObj: userObj, wantReason: "left the project"},
+		{name: "disabled manually without reason", userObj: userObj},
+		{name: "still frozen", reason: offboardReasonFrozen, userObj: frozen, wantReason: offboardReasonFrozen},
+		{name: "frozen", enabled: true, userObj: frozen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := testUser("alice@example.com", "ou-alice")
+			user.Enabled = &tt.enabled
+			if tt.reason != "" {
+				user.Attributes[attributeDisabledReason] = tt.reason
+				user.Attributes[attributeDisabledAt] = "2024-01-01T00:00:00Z"
+			}
+			updated, _ := genUser4Sync(user, tt.userObj, "")
+			if updated.Enabled == nil || *updated.Enabled != tt.wantEnabled {
+				t.Errorf("genUser4Sync() enabled = %v, want %v", updated.Enabled, tt.wantEnabled)
+			}
+			if got := updated.GetAttribute(attributeDisabledReason); got != tt.wantReason {
+				t.Errorf("genUser4Sync() disabled_reason = %q, want %q", got, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestApplyPlanSkipsNewerEvents(t *testing.T) {
+	log.Logger = logrus.New()
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	store.Init()
+	fetchedAt := time.Now()
+	version := func(at time.Time) *lm.ContactMsgHeader {
+		return &lm.ContactMsgHeader{CreateTime: strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)}
+	}
+	if err := recordEventVersion(entityUser, "ou-new", version(fetchedAt.Add(time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordEventVersion(entityUser, "ou-old", version(fetchedAt.Add(-time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordEventVersion(entityDepartment, "od-new", version(fetchedAt.Add(time.Second))); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := newPlan()
+	plan.fetchedAt = fetchedAt
+	var applied []string
+	for _, change := range []*Change{
+		{Op: opUpdateUser, LarkId: "ou-new"},
+		{Op: opUpdateUser, LarkId: "ou-old"},
+		{Op: opAddMembership, LarkId: "ou-new"},
+		{Op: opUpdateGroup, LarkId: "od-new"},
+		{Op: opUpdateGroup, LarkId: "ou-new"},
+	} {
+		change := change
+		change.apply = func(ctx context.Context, s *applyState) error {
+			applied = append(applied, change.Op+" "+change.LarkId)
+			return nil
+		}
+		plan.add(change)
+	}
+	if err := ApplyPlan(context.Background(), plan, true); err != nil {
+		t.Fatalf("ApplyPlan() error = %v", err)
+	}
+	want := []string{"update_user ou-old", "update_group ou-new"}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("ApplyPlan() applied %v, want %v", applied, want)
+	}
+}
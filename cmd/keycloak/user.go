@@ -1,25 +1,40 @@
 package keycloak
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"keycloak-lark-adapter/internal/config"
 	"keycloak-lark-adapter/internal/http"
+	log "keycloak-lark-adapter/internal/logger"
 	"keycloak-lark-adapter/internal/model/keycloak"
 	lm "keycloak-lark-adapter/internal/model/lark"
 	"keycloak-lark-adapter/pkg/utils"
 	http2 "net/http"
 	"strings"
+	"sync"
 )
 
-func processUserMsgWithType(msg *lm.ContactUserMsg) error {
-	token, err := getAppToken()
+// userCreateLock serializes picking usernames and creating users, see createUserForLark
+var userCreateLock sync.Mutex
+
+func processUserMsgWithType(ctx context.Context, msg *lm.ContactUserMsg) error {
+	logger := log.FromContext(ctx)
+	token, err := getAppToken(ctx)
 	if err != nil {
 		return err
 	}
 
+	// 没有email的员工使用企业邮箱或EMAIL_TEMPLATE生成的邮箱
+	fillEmail(msg.Event.Object)
+
 	eventType := msg.Header.EventType
+	// 延迟重发的旧事件可能回滚用户信息，早于已处理事件的事件按STALE_EVENT_POLICY处理
+	if isStaleEvent(entityUser, msg.Event.Object.OpenID, msg.Header) {
+		return staleUserEvent(ctx, token, msg)
+	}
+
 	switch eventType {
 	case eventTypeUserCreate:
 		// 新用户加入飞书后，在未登录过keycloak时，keycloak中没有该用户，则不需要同步期间任何用户变动信息。
@@ -27,16 +42,41 @@ func processUserMsgWithType(msg *lm.ContactUserMsg) error {
 		logger.Infof("process user create msg, currently using lark identity provider, do nothing")
 
 	case eventTypeUserDelete:
-		logger.Infof("received user %v delete msg, user will be deleted", msg.Event.Object.Email)
+		// 删除的用户不再等待分配email
+		if err = unparkUser(msg.Event.Object.OpenID); err != nil {
+			return err
+		}
+		// 超出同步范围的用户不做处理
+		inScope, err := larkUserInScope(ctx, msg.Event.Object)
+		if err != nil {
+			logger.Errorf("check scope of user %v failed, error: %v", describeUser(msg.Event.Object), err.Error())
+			return err
+		}
+		if !inScope {
+			logger.Infof("user %v is out of scope, skip delete action", describeUser(msg.Event.Object))
+			break
+		}
+		logger.Infof("received user %v delete msg, user will be offboarded", describeUser(msg.Event.Object))
 
-		err = userDelete(token, msg.Event.Object)
+		err = userDelete(ctx, token, msg.Event.Object)
 		if err != nil {
 			logger.Errorf("process user delete msg failed, error: %v", err.Error())
 			return err
 		}
 	case eventTypeUserUpdate:
+		inScope, err := larkUserInScope(ctx, msg.Event.Object)
+		if err != nil {
+			logger.Errorf("check scope of user %v failed, error: %v", describeUser(msg.Event.Object), err.Error())
+			return err
+		}
+		if !inScope {
+			if err = outOfScopeUser(ctx, token, msg.Event.Object); err != nil {
+				return err
+			}
+			break
+		}
 
-		err = userUpdate(token, msg.Event.Object, msg.Event.OldObject)
+		err = userUpdate(ctx, token, msg.Event.Object, msg.Event.OldObject)
 		if err != nil {
 			logger.Errorf("process user update msg failed, error: %v", err.Error())
 			return err
@@ -47,88 +87,74 @@ func processUserMsgWithType(msg *lm.ContactUserMsg) error {
 		return errors.New(errMsg)
 	}
 
-	return nil
+	if eventType == eventTypeUserDelete {
+		return forgetEventVersion(entityUser, msg.Event.Object.OpenID)
+	}
+	return recordEventVersion(entityUser, msg.Event.Object.OpenID, msg.Header)
 }
 
-func userUpdate(token string, userObj, userOldObj *lm.UserObject) error {
+func userUpdate(ctx context.Context, token string, userObj, userOldObj *lm.UserObject) error {
+	logger := log.FromContext(ctx)
 	// 1. 激活事件，do nothing
 	if userOldObj.Status != nil && !userOldObj.Status.IsActivated && userObj.Status.IsActivated {
 		logger.Infof("received user %v or %v activate msg, do nothing", userObj.Name, userObj.Email)
 		return nil
 	}
 
-	// 2. 修改email事件，直接删除keycloak中的老的email对应账号，并使用新的email创建一个新的用户
-	if len(userOldObj.Email) > 0 {
-		logger.Warnf("email changed from %v to %v, user will be deleted", userOldObj.Email, userObj.Email)
-
-		userInKeycloak, err := getUserDetail(token, userOldObj.Email)
-		if err != nil {
-			logger.Errorf("get user %v id failed, error: %v", userOldObj.Email, err.Error())
-			return err
-		}
-		if userInKeycloak == nil {
-			return fmt.Errorf("cannot find user %v in keycloak", userOldObj.Email)
-		}
-
-		err = deleteUserEngine(token, userInKeycloak.Id)
-		if err != nil {
-			logger.Errorf("email %v changed to %v, delete user failed, error: %v", userOldObj.Email, userObj.Email, err.Error())
-			return err
-		}
-
-		userCreate := genUser4Create(userObj)
-		logger.Infof("trying to create user %v in keycloak", userObj.Email)
-		err = createUser(token, userCreate)
-		if err != nil {
-			return err
-		}
-		userCreatedInKeycloak, err := getUserDetail(token, userCreate.Email)
-		if err != nil {
-			return err
-		}
+	// 冻结、离职的员工按照离职策略处理，不再同步其信息
+	if reason := getOffboardReason(userObj); reason != "" {
+		logger.Infof("user %v is %v in lark", describeUser(userObj), reason)
+		return userOffboard(ctx, token, userObj, reason)
+	}
 
-		// todo: check if no need to assign group
-		logger.Infof("trying to assign group %v to user %v",
-			userObj.DepartmentIDs[0], userObj.Email)
-		err = assignGroup2User(token, userCreatedInKeycloak.Id, userObj)
+	// 2. 修改email事件，在keycloak中原地更新用户的email，保留用户id、凭证、角色映射、会话等信息
+	oldObj, err := withKeycloakEmail(ctx, token, userObj, userOldObj)
+	if err != nil {
+		return err
+	}
+	if len(oldObj.Email) > 0 && len(userObj.Email) > 0 && !strings.EqualFold(oldObj.Email, userObj.Email) {
+		err := userEmailUpdate(ctx, token, userObj, oldObj)
 		if err != nil {
+			logger.Errorf("email %v changed to %v, update user failed, error: %v", oldObj.Email, userObj.Email, err.Error())
 			return err
 		}
-		return nil
 	}
 
-	// 3. 员工修改部门信息，若员工的email为空，报错。若员工在keycloak中不存在，进行创建。
+	// 3. 员工修改部门信息，若员工在keycloak中不存在，进行创建。既没有email也无法生成用户名的员工暂不创建，等待分配email后重试
 	if len(userOldObj.DepartmentIDs) >= 0 {
-		if len(userObj.Email) == 0 {
-			errMsg := fmt.Sprintf("assign %v's department before assign email", userObj.Name)
-			logger.Errorf(errMsg)
-			return errors.New(errMsg)
-		}
-
-		logger.Infof("user %v changes department to %v", userObj.Email, userObj.DepartmentIDs)
+		logger.Infof("user %v changes department to %v", describeUser(userObj), userObj.DepartmentIDs)
 
-		userInKeycloak, err := getUserDetail(token, userObj.Email)
+		userInKeycloak, err := findUser(ctx, token, userObj)
 		if err != nil {
 			return err
 		}
 		if userInKeycloak == nil {
-			logger.Infof("cannot find user %v in keycloak, trying to create", userObj.Email)
-
-			userCreate := genUser4Create(userObj)
-			err = createUser(token, userCreate)
-			if err != nil {
+			if baseUsername(userObj) == "" {
+				return parkUser(userObj)
+			}
+			logger.Infof("cannot find user %v in keycloak, trying to create", describeUser(userObj))
+			if err = createUserForLark(ctx, token, userObj); err != nil {
 				return err
 			}
-			userInKeycloak, err = getUserDetail(token, userObj.Email)
+			userInKeycloak, err = findUser(ctx, token, userObj)
 			if err != nil {
 				return err
 			}
+			if userInKeycloak == nil {
+				return fmt.Errorf("cannot find user %v in keycloak after creating it", describeUser(userObj))
+			}
+			if err = unparkUser(userObj.OpenID); err != nil {
+				return err
+			}
 		}
 
+		ctx = withKeycloakId(ctx, userInKeycloak.Id)
+		logger = log.FromContext(ctx)
+
 		// todo: check if no need to assign group
-		logger.Infof("Trying to assign group %v to user %v",
-			userObj.DepartmentIDs[0], userObj.Email)
-		err = assignGroup2User(token, userInKeycloak.Id, userObj)
+		logger.Infof("Trying to assign groups of departments %v to user %v",
+			userObj.DepartmentIDs, describeUser(userObj))
+		err = assignGroup2User(ctx, token, userInKeycloak.Id, userObj)
 		if err != nil {
 			return err
 		}
@@ -136,64 +162,149 @@ func userUpdate(token string, userObj, userOldObj *lm.UserObject) error {
 
 	// 4. 修改了员工信息，更新员工信息，并更新员工的部门信息
 	// todo check the necessary to update user
-	userNew, err := genUser4Update(token, userObj, userOldObj)
+	userNew, err := genUser4Update(ctx, token, userObj, userOldObj)
 	if err != nil {
 		logger.Errorf("generate user to update failed, error: %v", err.Error())
 		return err
 	}
-	err = updateUser(token, userNew.Id, userNew)
+	err = updateUser(ctx, token, userNew.Id, userNew)
 	if err != nil {
 		logger.Errorf("update user failed, error: %v", err.Error())
 		return err
 	}
+	// 员工重新启用或重新进入同步范围，取消计划中的删除
+	if err = cancelPendingDeletion(userNew.Id); err != nil {
+		return err
+	}
 
-	return nil
+	// 5. 按角色规则授予、回收角色
+	return userRoleRulesUpdate(ctx, token, userObj)
 }
 
-func userDelete(token string, userObj *lm.UserObject) error {
+// withKeycloakEmail returns the old object with the email of the keycloak user if the old object has no email but
+// the new one has. Users created before lark assigned an email carry the enterprise email or the address built from
+// EMAIL_TEMPLATE, marked by the lark_email_source attribute, and the assigned email replaces it in place like any
+// email change. Emails of unmarked users are left to the regular email change handling.
+func withKeycloakEmail(ctx context.Context, token string, userObj, userOldObj *lm.UserObject) (*lm.UserObject, error) {
+	if userOldObj.Email != "" || userObj.Email == "" {
+		return userOldObj, nil
+	}
+	userInKeycloak, err := findUser(ctx, token, userObj)
+	if err != nil || userInKeycloak == nil || userInKeycloak.Email == "" || userInKeycloak.GetAttribute(attributeLarkEmailSource) == "" {
+		return userOldObj, err
+	}
+	oldObj := *userOldObj
+	oldObj.Email = userInKeycloak.Email
+	return &oldObj, nil
+}
+
+// userEmailUpdate changes the email of the keycloak user in place, the username follows the email
+// according to config.EmailChangeUsernamePolicy
+func userEmailUpdate(ctx context.Context, token string, userObj, userOldObj *lm.UserObject) error {
+	logger := log.FromContext(ctx)
+	logger.Infof("email changed from %v to %v, updating user in keycloak", userOldObj.Email, userObj.Email)
 
-	userInKeycloak, err := getUserDetail(token, userObj.Email)
+	// the keycloak user still holds the old email
+	lookupObj := *userObj
+	lookupObj.Email = userOldObj.Email
+	userInKeycloak, err := findUser(ctx, token, &lookupObj)
 	if err != nil {
-		logger.Errorf("get user %v failed, error: %v", userObj.Email, err.Error())
+		logger.Errorf("get user %v id failed, error: %v", userOldObj.Email, err.Error())
 		return err
 	}
 	if userInKeycloak == nil {
-		logger.Infof("cannot find user %v in keycloak, skip delete action", userObj.Email)
+		logger.Infof("cannot find user %v in keycloak, it will be created with email %v", userOldObj.Email, userObj.Email)
 		return nil
 	}
 
-	err = deleteUserEngine(token, userInKeycloak.Id)
+	user := *userInKeycloak
+	user.Email = userObj.Email
+	if user.Attributes == nil {
+		user.Attributes = map[string]interface{}{}
+	}
+	setEmailSource(user.Attributes, userObj)
+	// 用户名由邮箱生成时，用户名随邮箱变化，冲突时按USERNAME_STRATEGY的规则加后缀
+	if config.EmailChangeUsernamePolicy == usernamePolicyUpdate && isUsernameOf(userInKeycloak, &lookupObj) &&
+		baseUsername(&lookupObj) != baseUsername(userObj) {
+		userList, err := getUserList(ctx, token)
+		if err != nil {
+			return err
+		}
+		owners := usernameOwners{}
+		for _, item := range userList {
+			if item.Id != user.Id {
+				owners.add(item.Username, item.GetAttribute(attributeLarkOpenId))
+			}
+		}
+		user.Username = pickUsernameFrom(userObj, owners)
+	}
+	if user.Email == userInKeycloak.Email && user.Username == userInKeycloak.Username {
+		logger.Infof("user %v already has email %v, skip email update", user.Id, user.Email)
+		return nil
+	}
+
+	if err = checkUserConflict(ctx, token, &user); err != nil {
+		return err
+	}
+	return updateUser(ctx, token, user.Id, &user)
+}
+
+// checkUserConflict returns an error if another keycloak user already owns the email or username of the user,
+// keycloak would otherwise reject the update or, with duplicate emails allowed, two accounts would share the email
+func checkUserConflict(ctx context.Context, token string, user *keycloak.User) error {
+	logger := log.FromContext(ctx)
+	userList, err := getUserList(ctx, token)
 	if err != nil {
-		logger.Errorf("delete user failed, error: %v", err.Error())
 		return err
 	}
+
+	for _, item := range userList {
+		if item.Id == user.Id {
+			continue
+		}
+		if (user.Email != "" && strings.EqualFold(item.Email, user.Email)) || strings.EqualFold(item.Username, user.Username) {
+			errMsg := fmt.Sprintf("email %v or username %v of user %v already belongs to keycloak user %v(%v), skip overwriting it",
+				user.Email, user.Username, user.Id, item.Username, item.Id)
+			logger.Errorf(errMsg)
+			return errors.New(errMsg)
+		}
+	}
 	return nil
 }
 
-func getUserDetail(token, userName string) (user *keycloak.User, err error) {
-	userList, err := getUserList(token)
+func userDelete(ctx context.Context, token string, userObj *lm.UserObject) error {
+	logger := log.FromContext(ctx)
+
+	// delete events may carry no email, the user is matched by its lark ids as well
+	userInKeycloak, err := findUser(ctx, token, userObj)
 	if err != nil {
-		logger.Errorf("get user list from keycloak failed, error: %v", err.Error())
-		return
+		logger.Errorf("get user %v failed, error: %v", describeUser(userObj), err.Error())
+		return err
 	}
-	if len(userList) == 0 {
-		logger.Errorf("get user list empty")
-		return nil, errors.New("get user list empty from keycloak")
+	if userInKeycloak == nil {
+		logger.Infof("cannot find user %v in keycloak, skip delete action", describeUser(userObj))
+		return nil
 	}
-	for _, userItem := range userList {
-		if userName == userItem.Username {
-			logger.Debugf("get user detail from keycloak: %v", userItem)
-			return userItem, nil
-		}
+
+	err = offboardUser(ctx, token, userInKeycloak, offboardReasonDeleted)
+	if err != nil {
+		logger.Errorf("offboard user failed, error: %v", err.Error())
+		return err
 	}
-	errMsg := fmt.Sprintf("cannot find user %v in keycloak", userName)
-	logger.Errorf(errMsg)
-	return nil, nil
+	return nil
+}
+
+func getUserList(ctx context.Context, token string) (userList []*keycloak.User, err error) {
+	return searchUsers(ctx, token, nil)
 }
 
-func getUserList(token string) (userList []*keycloak.User, err error) {
+// searchUsers lists keycloak users filtered by the query params
+func searchUsers(ctx context.Context, token string, params map[string]string) (userList []*keycloak.User, err error) {
+	logger := log.FromContext(ctx)
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Authorization", token).
+		SetQueryParams(params).
 		SetQueryParam("max", "10000").
 		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/users")
 	if err != nil {
@@ -213,13 +324,16 @@ func getUserList(token string) (userList []*keycloak.User, err error) {
 	return
 }
 
-func updateUser(token, userId string, user *keycloak.User) error {
-	logger.Debugf("updating user with body: %v", user)
+func updateUser(ctx context.Context, token, userId string, user *keycloak.User) error {
+	logger := log.FromContext(ctx)
+	logger.Debugf("updating user %v", userId)
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
 		SetBody(*user).
-		Put(config.Host + "/auth/admin/realms/" + config.Realm + "/users/" + userId)
+		SetPathParams(map[string]string{"id": userId}).
+		Put(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}")
 	if err != nil {
 		logger.Errorf("update user failed, error: %v", err.Error())
 		return err
@@ -233,11 +347,14 @@ func updateUser(token, userId string, user *keycloak.User) error {
 	return nil
 }
 
-func deleteUserEngine(token, userId string) error {
+func deleteUserEngine(ctx context.Context, token, userId string) error {
+	logger := log.FromContext(ctx)
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
-		Delete(config.Host + "/auth/admin/realms/" + config.Realm + "/users/" + userId)
+		SetPathParams(map[string]string{"id": userId}).
+		Delete(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}")
 	if err != nil {
 		logger.Errorf("delete user in keycloak failed, error: %v", err.Error())
 		return err
@@ -274,134 +391,193 @@ func parseName(name string) (realName string, nickname string) {
 
 }
 
-func createUser(token string, user *keycloak.User) error {
+// createUserForLark creates the keycloak user of the lark user. The username is picked and the user is created under
+// userCreateLock, users created by events processed in parallel would otherwise pick the same free username.
+func createUserForLark(ctx context.Context, token string, userObj *lm.UserObject) error {
+	userCreateLock.Lock()
+	defer userCreateLock.Unlock()
+
+	user := genUser4Create(userObj)
+	if err := uniqueUsername(ctx, token, user, userObj); err != nil {
+		return err
+	}
+	_, err := createUser(ctx, token, user)
+	return err
+}
+
+// createUser creates the user in keycloak and returns its id
+func createUser(ctx context.Context, token string, user *keycloak.User) (userId string, err error) {
+	logger := log.FromContext(ctx)
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
 		SetBody(user).
 		Post(config.Host + "/auth/admin/realms/" + config.Realm + "/users")
 	if err != nil {
 		logger.Errorf("create user in keycloak failed, error: %v", err.Error())
-		return err
+		return "", err
 	}
 	if !utils.IsSuccessResponse(resp.StatusCode()) {
 		errMsg := fmt.Sprintf("create user response failed, code: %v, error msg: %v", resp.StatusCode(), string(resp.Body()))
 		logger.Errorf(errMsg)
 
-		return errors.New(errMsg)
+		return "", errors.New(errMsg)
 	}
 
-	return nil
+	return getIdFromLocation(resp.Header().Get("Location")), nil
 }
 
-func genUser4Update(token string, userObj *lm.UserObject, userOldObj *lm.UserObject) (user *keycloak.User, err error) {
+func genUser4Update(ctx context.Context, token string, userObj *lm.UserObject, userOldObj *lm.UserObject) (user *keycloak.User, err error) {
+	logger := log.FromContext(ctx)
 	user = &keycloak.User{}
 
-	// keycloak using email as username
-	username := userObj.Email
-
 	// keycloak中更新user时attributes是覆盖的，attributes需要先get再set
-	userOldInKeycloak, err := getUserDetail(token, username)
+	userOldInKeycloak, err := findUser(ctx, token, userObj)
 	if err != nil {
 		return nil, err
 	}
 	if userOldInKeycloak == nil {
-		return nil, fmt.Errorf("cannot find user %v in keycloak", username)
+		return nil, fmt.Errorf("cannot find user %v in keycloak", describeUser(userObj))
 	}
 
 	attrs := userOldInKeycloak.Attributes
 	if attrs == nil {
 		attrs = map[string]interface{}{}
 	}
-	if userOldObj.Mobile != "" || userObj.Mobile != "" {
-		attrs[attributePhoneNumber] = userObj.Mobile
-	}
-	if userOldObj.Name != "" || userObj.Name != "" {
-		realName, nickName := parseName(userObj.Name)
-		attrs[attributeRealName] = realName
-		attrs[attributeNickname] = nickName
-		user.LastName = realName
-		user.FirstName = realName
+	setLarkIdAttributes(attrs, userObj)
+	setPrimaryDepId(attrs, userObj)
+	manager, err := leaderValue(ctx, token, userObj.LeaderUserID)
+	if err != nil {
+		return nil, err
 	}
+	setUserManager(attrs, userObj.LeaderUserID, manager)
 	user.Attributes = attrs
+	// 事件中的user是完整的飞书用户信息，每次更新都按映射配置设置所有字段
+	applyAttributeMappings(user, userObj)
 	user.Id = userOldInKeycloak.Id
 
 	user.Enabled = userOldInKeycloak.Enabled
-	if userOldObj.Status != nil {
-		// 更新后的user是冻结状态，需要在keycloak中禁用user
-		if userObj.Status.IsFrozen {
-			// disable user
-			logger.Infof("preparing to disable user %v", userObj.Email)
-			*user.Enabled = false
-		} else {
-			logger.Infof("preparing to enable user %v", userObj.Email)
-			*user.Enabled = true
-		}
+	// 冻结、离职的user由离职策略处理，这里的user在飞书中是正常状态。adapter禁用的user重新启用，手工禁用的user保持禁用
+	if isAdapterDisabled(userOldInKeycloak) {
+		logger.Infof("preparing to enable user %v", userObj.Email)
+		enabled := true
+		user.Enabled = &enabled
+		clearOffboarding(attrs)
 	}
 
 	return
 }
 
-func deleteUserGroup(token, userId string) error {
+func getUserGroups(ctx context.Context, token, userId string) (userGroups []*keycloak.GroupInfo, err error) {
+	logger := log.FromContext(ctx)
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
-		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/users/" + userId + "/groups")
+		SetPathParams(map[string]string{"id": userId}).
+		Get(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}/groups")
 	if err != nil {
 		logger.Errorf("get user %v groups failed, error: %v", userId, err.Error())
-		return err
+		return nil, err
 	}
 	if !utils.IsSuccessResponse(resp.StatusCode()) {
 		errMsg := fmt.Sprintf("get user %v groups failed, response code: %v, response bdoy: %v", userId, resp.StatusCode(), string(resp.Body()))
 		logger.Errorf(errMsg)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
-	userGroups := []*keycloak.GroupInfo{}
+	userGroups = []*keycloak.GroupInfo{}
 	err = json.Unmarshal(resp.Body(), &userGroups)
 	if err != nil {
 		logger.Errorf("unmarshal user %v groups info failed, error: %v", userId, err.Error())
-		return err
+		return nil, err
 	}
+	return userGroups, nil
+}
 
-	for _, ug := range userGroups {
-		resp, err := http.Client.R().
-			SetHeader("Content-Type", "application/json").
-			SetHeader("Authorization", token).
-			Delete(config.Host + "/auth/admin/realms/" + config.Realm + "/users/" + userId + "/groups/" + ug.ID)
-		if err != nil {
-			logger.Errorf("delete user %v group %v failed, error: %v", userId, ug.ID, err.Error())
-			return err
-		}
+func userGroupDeleteEngine(ctx context.Context, token, userId, groupId string) error {
+	logger := log.FromContext(ctx)
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetPathParams(map[string]string{"id": userId, "group": groupId}).
+		Delete(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}/groups/{group}")
+	if err != nil {
+		logger.Errorf("delete user %v group %v failed, error: %v", userId, groupId, err.Error())
+		return err
+	}
 
-		if !utils.IsSuccessResponse(resp.StatusCode(), http2.StatusNotFound) {
-			errMsg := fmt.Sprintf("delete user %v group %v failed, code: %v, error msg: %v", userId, ug.ID, resp.StatusCode(), string(resp.Body()))
-			logger.Errorf(errMsg)
+	if !utils.IsSuccessResponse(resp.StatusCode(), http2.StatusNotFound) {
+		errMsg := fmt.Sprintf("delete user %v group %v failed, code: %v, error msg: %v", userId, groupId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
 
-			return errors.New(errMsg)
-		}
+		return errors.New(errMsg)
 	}
-
 	return nil
 }
 
-// 飞书中只能给用户指定一个部门，而keycloak可以给用户指定多个group，需要删除keycloak中用户原有的group后再指定新的group。
-// 飞书中当前展示的组织架构从公司下面的一级部门开始，keycloak中的group也是从一级部门开始。而飞书后台可以给用户指定部门为公司，
-// 此时认为用户不属于任何一个部门，在keycloak中删除该用户的所有group信息。
-func assignGroup2User(token, userId string, userObj *lm.UserObject) error {
-	groupId, err := getGroupIdInKeycloak(token, userObj)
+// 飞书中用户可以属于多个部门，keycloak中用户的group设置为飞书中所有部门对应的group。
+// 只有adapter管理的group会被移除，手工维护的group（如admins或应用自己的group）不受影响。先加入新的group再移除多余的group，
+// 避免用户在变更期间没有任何group。飞书后台可以给用户指定部门为公司，此时认为用户不属于该部门。
+func assignGroup2User(ctx context.Context, token, userId string, userObj *lm.UserObject) error {
+	logger := log.FromContext(ctx)
+	groupIds, err := getGroupIdsInKeycloak(ctx, token, userObj)
 	if err != nil {
 		return err
 	}
+	desired := map[string]bool{}
+	for _, groupId := range groupIds {
+		desired[groupId] = true
+	}
 
-	err = deleteUserGroup(token, userId)
+	userGroups, err := getUserGroups(ctx, token, userId)
 	if err != nil {
 		return err
 	}
-	if groupId == "" {
-		logger.Infof("lark set user %v department to root, delete user's group in keycloak", userId)
-		return nil
+	actual := map[string]bool{}
+	for _, ug := range userGroups {
+		actual[ug.ID] = true
+	}
+
+	for _, groupId := range groupIds {
+		if actual[groupId] {
+			continue
+		}
+		if err = userGroupAddEngine(ctx, token, userId, groupId); err != nil {
+			return err
+		}
+	}
+
+	// the groups of a user come without attributes, they are looked up in the group tree
+	groups, err := getGroups(ctx, token)
+	if err != nil {
+		return err
 	}
+	managed := map[string]bool{}
+	walkGroups(groups, func(group *keycloak.GroupInfo) bool {
+		managed[group.ID] = isManagedGroup(group)
+		return true
+	})
 
+	for _, ug := range userGroups {
+		if desired[ug.ID] {
+			continue
+		}
+		if !managed[ug.ID] {
+			logger.Debugf("group %v of user %v is not managed by the adapter, keep it", ug.Path, userId)
+			continue
+		}
+		logger.Infof("removing user %v from group %v", userId, ug.Path)
+		if err = userGroupDeleteEngine(ctx, token, userId, ug.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func userGroupAddEngine(ctx context.Context, token, userId, groupId string) error {
+	logger := log.FromContext(ctx)
 	groupAssignment := &keycloak.GroupAssignment{
 		GroupID: groupId,
 		Realm:   config.Realm,
@@ -409,10 +585,12 @@ func assignGroup2User(token, userId string, userObj *lm.UserObject) error {
 	}
 
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
 		SetBody(groupAssignment).
-		Put(config.Host + "/auth/admin/realms/" + config.Realm + "/users/" + userId + "/groups/" + groupId)
+		SetPathParams(map[string]string{"id": userId, "group": groupId}).
+		Put(config.Host + "/auth/admin/realms/" + config.Realm + "/users/{id}/groups/{group}")
 	if err != nil {
 		logger.Errorf("assign grouop %v to user %v failed, error: %v", groupId, userId, err.Error())
 		return err
@@ -429,22 +607,42 @@ func assignGroup2User(token, userId string, userObj *lm.UserObject) error {
 
 func genUser4Create(userObj *lm.UserObject) (user *keycloak.User) {
 	user = &keycloak.User{}
-	// keycloak using email as username
-	user.Username = userObj.Email
+	// 按USERNAME_STRATEGY生成用户名，创建前由uniqueUsername处理冲突
+	user.Username = baseUsername(userObj)
 	user.Email = userObj.Email
 	enable := true
 	user.Enabled = &enable
 
 	attrs := map[string]interface{}{}
-	attrs[attributePhoneNumber] = userObj.Mobile
-
-	realName, nickName := parseName(userObj.Name)
-	attrs[attributeRealName] = realName
-	attrs[attributeNickname] = nickName
+	setPrimaryDepId(attrs, userObj)
+	setLarkIdAttributes(attrs, userObj)
+	setEmailSource(attrs, userObj)
 	user.Attributes = attrs
-
-	user.LastName = realName
-	user.FirstName = realName
+	applyAttributeMappings(user, userObj)
 
 	return user
 }
+
+// setPrimaryDepId records the primary department of the user, the attribute is removed if the user has no department
+func setPrimaryDepId(attrs map[string]interface{}, userObj *lm.UserObject) {
+	if depId := getPrimaryDepId(userObj); depId != "" {
+		attrs[attributeLarkPrimaryDepartmentId] = depId
+	} else {
+		delete(attrs, attributeLarkPrimaryDepartmentId)
+	}
+}
+
+// setLarkIdAttributes records the lark identifiers of the user, so that the user can be matched without email
+func setLarkIdAttributes(attrs map[string]interface{}, userObj *lm.UserObject) {
+	ids := map[string]string{
+		attributeLarkOpenId:     userObj.OpenID,
+		attributeLarkUnionId:    userObj.UnionID,
+		attributeLarkUserId:     userObj.UserID,
+		attributeLarkEmployeeNo: userObj.EmployeeNo,
+	}
+	for key, value := range ids {
+		if value != "" {
+			attrs[key] = value
+		}
+	}
+}
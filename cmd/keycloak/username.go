@@ -0,0 +1,167 @@
+package keycloak
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	usernameStrategyEmail          = "email"
+	usernameStrategyEmailLocalPart = "email_local_part"
+	usernameStrategyEmployeeNo     = "employee_no"
+	usernameStrategyUserId         = "user_id"
+	usernameStrategyTemplate       = "template"
+
+	// usernameSuffixLen is the length of the hex suffix appended to taken usernames
+	usernameSuffixLen = 6
+)
+
+// usernameTemplate renders USERNAME_TEMPLATE, it reuses the template handling of the attribute mappings
+var usernameTemplate *AttributeMapping
+
+func initUsernameStrategy() {
+	switch config.UsernameStrategy {
+	case usernameStrategyEmail, usernameStrategyEmailLocalPart, usernameStrategyEmployeeNo, usernameStrategyUserId:
+	case usernameStrategyTemplate:
+		if config.UsernameTemplate == "" {
+			logger.Fatalf("USERNAME_TEMPLATE is required by USERNAME_STRATEGY %v", config.UsernameStrategy)
+		}
+		tmpl, err := template.New("username").Parse(config.UsernameTemplate)
+		if err != nil {
+			logger.Fatalf("invalid param USERNAME_TEMPLATE %v, error: %v", config.UsernameTemplate, err)
+		}
+		usernameTemplate = &AttributeMapping{Template: config.UsernameTemplate, Target: "username", tmpl: tmpl}
+	default:
+		logger.Fatalf("unsupported USERNAME_STRATEGY %v, should be email, email_local_part, employee_no, user_id or template", config.UsernameStrategy)
+	}
+}
+
+// baseUsername returns the username of the lark user by USERNAME_STRATEGY in lower case as keycloak stores it.
+// Users without the field of the strategy fall back to their email.
+func baseUsername(userObj *lm.UserObject) string {
+	var username string
+	switch config.UsernameStrategy {
+	case usernameStrategyEmailLocalPart:
+		if idx := strings.LastIndex(userObj.Email, "@"); idx > 0 {
+			username = userObj.Email[:idx]
+		}
+	case usernameStrategyEmployeeNo:
+		username = userObj.EmployeeNo
+	case usernameStrategyUserId:
+		username = userObj.UserID
+	case usernameStrategyTemplate:
+		username = usernameTemplate.value(larkUserFields(userObj))
+	}
+	if strings.TrimSpace(username) == "" {
+		username = userObj.Email
+	}
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// usernameSuffix is derived from the lark user, so the same user always resolves a collision to the same username
+func usernameSuffix(userObj *lm.UserObject) string {
+	id := userObj.UnionID
+	if id == "" {
+		id = userObj.OpenID
+	}
+	sum := sha1.Sum([]byte(id))
+	return hex.EncodeToString(sum[:])[:usernameSuffixLen]
+}
+
+// usernameOwners maps the lower case usernames of keycloak users to the lark open id in their lark_open_id attribute,
+// "" for users not bound to lark
+type usernameOwners map[string]string
+
+func newUsernameOwners(userList []*keycloak.User) usernameOwners {
+	owners := make(usernameOwners, len(userList))
+	for _, user := range userList {
+		owners.add(user.Username, user.GetAttribute(attributeLarkOpenId))
+	}
+	return owners
+}
+
+func (o usernameOwners) add(username, openId string) {
+	o[strings.ToLower(username)] = openId
+}
+
+// takenFor reports whether the username belongs to a keycloak user other than the one bound to the lark user, a
+// username of a user bound to the same open id is free for it
+func (o usernameOwners) takenFor(username string, userObj *lm.UserObject) bool {
+	owner, ok := o[username]
+	return ok && (owner == "" || owner != userObj.OpenID)
+}
+
+// pickUsername returns the first candidate username of the lark user which is not taken by another keycloak user,
+// "" if the lark user has neither the field of the strategy nor an email
+func pickUsername(userObj *lm.UserObject, userList []*keycloak.User) string {
+	return pickUsernameFrom(userObj, newUsernameOwners(userList))
+}
+
+// pickUsernameFrom tries the username of the strategy, then with the suffix of the user, then with a counter after
+// the suffix, and returns the first one which is not taken
+func pickUsernameFrom(userObj *lm.UserObject, owners usernameOwners) string {
+	base := baseUsername(userObj)
+	if base == "" || !owners.takenFor(base, userObj) {
+		return base
+	}
+	suffixed := base + "-" + usernameSuffix(userObj)
+	candidate := suffixed
+	for i := 2; owners.takenFor(candidate, userObj); i++ {
+		candidate = fmt.Sprintf("%v-%v", suffixed, i)
+	}
+	return candidate
+}
+
+// isUsernameOf reports whether the username of the keycloak user is one of the usernames pickUsername may return for
+// the lark user. Users bound to another lark user never match, and the suffixed usernames, which are only picked on
+// collisions, match only the user bound to the lark user.
+func isUsernameOf(user *keycloak.User, userObj *lm.UserObject) bool {
+	base := baseUsername(userObj)
+	if base == "" {
+		return false
+	}
+	if isBoundToOther(user, userObj) {
+		return false
+	}
+	username := strings.ToLower(user.Username)
+	if username == base {
+		return true
+	}
+	if user.GetAttribute(attributeLarkOpenId) == "" {
+		return false
+	}
+	suffixed := base + "-" + usernameSuffix(userObj)
+	if username == suffixed {
+		return true
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(username, suffixed+"-"))
+	return strings.HasPrefix(username, suffixed+"-") && err == nil && n >= 2
+}
+
+// uniqueUsername sets the username of the user to be created for the lark user, resolving collisions with the
+// existing keycloak users
+func uniqueUsername(ctx context.Context, token string, user *keycloak.User, userObj *lm.UserObject) error {
+	logger := log.FromContext(ctx)
+	userList, err := getUserList(ctx, token)
+	if err != nil {
+		return err
+	}
+	username := pickUsername(userObj, userList)
+	if username == "" {
+		return fmt.Errorf("cannot build username of user %v with USERNAME_STRATEGY %v", describeUser(userObj), config.UsernameStrategy)
+	}
+	if username != baseUsername(userObj) {
+		logger.Infof("username %v is taken, using %v for user %v", baseUsername(userObj), username, describeUser(userObj))
+	}
+	user.Username = username
+	return nil
+}
@@ -0,0 +1,82 @@
+package keycloak
+
+import (
+	"keycloak-lark-adapter/internal/config"
+	"keycloak-lark-adapter/internal/model/keycloak"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"testing"
+)
+
+// testUser returns a keycloak user bound to the lark open id, unbound if openId is empty
+func testUser(username, openId string) *keycloak.User {
+	user := &keycloak.User{Username: username, Attributes: map[string]interface{}{}}
+	if openId != "" {
+		user.Attributes[attributeLarkOpenId] = openId
+	}
+	return user
+}
+
+func TestPickUsername(t *testing.T) {
+	config.UsernameStrategy = usernameStrategyEmail
+	userObj := &lm.UserObject{OpenID: "ou-alice", Email: "alice@example.com"}
+	suffixed := "alice@example.com-" + usernameSuffix(userObj)
+
+	tests := []struct {
+		name  string
+		users []*keycloak.User
+		want  string
+	}{
+		{name: "free", want: "alice@example.com"},
+		{name: "taken by an unbound user", users: []*keycloak.User{testUser("Alice@example.com", "")}, want: suffixed},
+		{name: "taken by another lark user", users: []*keycloak.User{testUser("alice@example.com", "ou-bob")}, want: suffixed},
+		{name: "owned by the same lark user", users: []*keycloak.User{testUser("alice@example.com", "ou-alice")}, want: "alice@example.com"},
+		{
+			name:  "suffixed username taken as well",
+			users: []*keycloak.User{testUser("alice@example.com", ""), testUser(suffixed, "ou-bob")},
+			want:  suffixed + "-2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickUsername(userObj, tt.users); got != tt.want {
+				t.Errorf("pickUsername() = %v, want %v", got, tt.want)
+			}
+			// the full sync picks from the usernames of its state by the same rule
+			owners := usernameOwners{}
+			for _, user := range tt.users {
+				owners.add(user.Username, user.GetAttribute(attributeLarkOpenId))
+			}
+			if got := pickUsernameFrom(userObj, owners); got != tt.want {
+				t.Errorf("pickUsernameFrom() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsUsernameOf(t *testing.T) {
+	config.UsernameStrategy = usernameStrategyEmail
+	userObj := &lm.UserObject{OpenID: "ou-alice", Email: "alice@example.com"}
+	suffixed := "alice@example.com-" + usernameSuffix(userObj)
+
+	tests := []struct {
+		name string
+		user *keycloak.User
+		want bool
+	}{
+		{name: "base username of an unbound user", user: testUser("Alice@example.com", ""), want: true},
+		{name: "base username of the bound user", user: testUser("alice@example.com", "ou-alice"), want: true},
+		{name: "base username of another lark user", user: testUser("alice@example.com", "ou-bob")},
+		{name: "suffixed username of the bound user", user: testUser(suffixed, "ou-alice"), want: true},
+		{name: "counted username of the bound user", user: testUser(suffixed+"-3", "ou-alice"), want: true},
+		{name: "counted username of another lark user", user: testUser(suffixed+"-3", "ou-bob")},
+		{name: "suffixed username of an unbound user", user: testUser(suffixed, "")},
+		{name: "suffixed username with a name after it", user: testUser(suffixed+"-admin", "ou-alice")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isUsernameOf(tt.user, userObj); got != tt.want {
+				t.Errorf("isUsernameOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"keycloak-lark-adapter/cmd/lark"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"keycloak-lark-adapter/internal/store"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// bucketEventVersions records the create time of the last applied event per lark user and department
+	bucketEventVersions = "event_versions"
+	// bucketSync records the state of full syncs
+	bucketSync = "sync"
+	// keyEventVersionFloor is the time the last successful full sync fetched lark, events created before are stale
+	keyEventVersionFloor = "event_version_floor"
+
+	entityUser       = "user"
+	entityDepartment = "department"
+
+	staleEventSkip    = "skip"
+	staleEventRefetch = "refetch"
+)
+
+var (
+	staleEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lark_stale_events_total",
+		Help: "Lark contact events older than the last applied event of the same entity, by entity and action taken.",
+	}, []string{"entity", "action"})
+)
+
+func validateStaleEventConfig() {
+	switch config.StaleEventPolicy {
+	case staleEventSkip, staleEventRefetch:
+	default:
+		logger.Fatalf("unsupported STALE_EVENT_POLICY %v, should be skip or refetch", config.StaleEventPolicy)
+	}
+}
+
+// eventTime returns the create time of the event in milliseconds, 0 if the header carries none
+func eventTime(header *lm.ContactMsgHeader) int64 {
+	if header == nil {
+		return 0
+	}
+	ms, err := strconv.ParseInt(header.CreateTime, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return ms
+}
+
+// isStaleEvent reports whether an event of the entity newer than the event has been applied already.
+// Events with the same create time are not stale, they may be redeliveries of the last event.
+func isStaleEvent(entity, id string, header *lm.ContactMsgHeader) bool {
+	createTime := eventTime(header)
+	if createTime == 0 || id == "" {
+		return false
+	}
+	var floor, applied int64
+	store.Get(bucketSync, keyEventVersionFloor, &floor)
+	store.Get(bucketEventVersions, entity+":"+id, &applied)
+	return createTime < floor || createTime < applied
+}
+
+// recordEventVersion records the create time of the applied event, older create times are never recorded.
+// Versions are written to the state file in batches by the flush of the store, a crash loses the last few seconds.
+func recordEventVersion(entity, id string, header *lm.ContactMsgHeader) error {
+	createTime := eventTime(header)
+	if createTime == 0 || id == "" {
+		return nil
+	}
+	var applied int64
+	if ok, err := store.Get(bucketEventVersions, entity+":"+id, &applied); err != nil || (ok && applied >= createTime) {
+		return err
+	}
+	return store.PutDeferred(bucketEventVersions, entity+":"+id, createTime)
+}
+
+// appliedSince reports whether an event of the entity created at or after since has been applied, a sync which
+// fetched lark at since must not overwrite the state of the event
+func appliedSince(entity, id string, since time.Time) bool {
+	if id == "" || since.IsZero() {
+		return false
+	}
+	var applied int64
+	store.Get(bucketEventVersions, entity+":"+id, &applied)
+	return applied >= since.UnixNano()/int64(time.Millisecond)
+}
+
+// forgetEventVersion removes the version of a deleted lark user or department, the state file would grow with every
+// deleted entity otherwise. Stale events of the entity delivered afterwards are caught by the floor of the next sync.
+func forgetEventVersion(entity, id string) error {
+	if id == "" {
+		return nil
+	}
+	return store.Delete(bucketEventVersions, entity+":"+id)
+}
+
+// recordEventVersionFloor records the time a successful full sync fetched lark as the version of every user and
+// department: the sync applied their state as of then, so older events are stale. The versions it supersedes are
+// pruned.
+func recordEventVersionFloor(ctx context.Context, floor int64) error {
+	logger := log.FromContext(ctx)
+	if err := store.Put(bucketSync, keyEventVersionFloor, floor); err != nil {
+		return err
+	}
+	pruned, err := store.Prune(bucketEventVersions, func(key string, raw json.RawMessage) bool {
+		var applied int64
+		return json.Unmarshal(raw, &applied) == nil && applied <= floor
+	})
+	if err != nil {
+		return err
+	}
+	logger.Infof("event version floor set to %v, %v event versions pruned", floor, pruned)
+	return nil
+}
+
+// staleUserEvent handles a stale user event according to STALE_EVENT_POLICY: it is skipped, or the current state
+// of the user is fetched from lark and applied instead
+func staleUserEvent(ctx context.Context, token string, msg *lm.ContactUserMsg) error {
+	logger := log.FromContext(ctx)
+	userObj := msg.Event.Object
+	if config.StaleEventPolicy != staleEventRefetch {
+		logger.Warnf("skip stale %v event %v of user %v", msg.Header.EventType, msg.Header.EventID, describeUser(userObj))
+		staleEventsTotal.WithLabelValues(entityUser, staleEventSkip).Inc()
+		return nil
+	}
+
+	logger.Warnf("stale %v event %v of user %v, applying the current state in lark instead", msg.Header.EventType, msg.Header.EventID, describeUser(userObj))
+	staleEventsTotal.WithLabelValues(entityUser, staleEventRefetch).Inc()
+	current, err := lark.GetUser(ctx, userObj.OpenID)
+	if errors.Is(err, lark.ErrUserNotFound) {
+		// the user was deleted in lark after the event, it is offboarded like by its delete event
+		if err = unparkUser(userObj.OpenID); err != nil {
+			return err
+		}
+		inScope, err := larkUserInScope(ctx, userObj)
+		if err != nil {
+			return err
+		}
+		if !inScope {
+			logger.Infof("user %v does not exist in lark anymore and is out of scope, skip it", describeUser(userObj))
+			return nil
+		}
+		logger.Infof("user %v does not exist in lark anymore, user will be offboarded", describeUser(userObj))
+		return userDelete(ctx, token, userObj)
+	}
+	if err != nil {
+		return err
+	}
+	fillEmail(current)
+	inScope, err := larkUserInScope(ctx, current)
+	if err != nil {
+		return err
+	}
+	if !inScope {
+		return outOfScopeUser(ctx, token, current)
+	}
+	// an empty old object updates every field
+	return userUpdate(ctx, token, current, &lm.UserObject{})
+}
+
+// staleDepEvent handles a stale department event according to STALE_EVENT_POLICY, see staleUserEvent
+func staleDepEvent(ctx context.Context, token string, msg *lm.ContactDepMsg) error {
+	logger := log.FromContext(ctx)
+	depObj := msg.Event.Object
+	if config.StaleEventPolicy != staleEventRefetch {
+		logger.Warnf("skip stale %v event %v of department %v", msg.Header.EventType, msg.Header.EventID, depObj.OpenDepartmentID)
+		staleEventsTotal.WithLabelValues(entityDepartment, staleEventSkip).Inc()
+		return nil
+	}
+
+	logger.Warnf("stale %v event %v of department %v, applying the current state in lark instead", msg.Header.EventType, msg.Header.EventID, depObj.OpenDepartmentID)
+	staleEventsTotal.WithLabelValues(entityDepartment, staleEventRefetch).Inc()
+	dep, err := lark.GetDepartment(ctx, depObj.OpenDepartmentID)
+	if err != nil {
+		return err
+	}
+	current := &lm.DepObject{
+		OpenDepartmentID:   dep.OpenDepartmentID,
+		DepartmentID:       dep.DepartmentID,
+		Name:               dep.Name,
+		ParentDepartmentID: dep.ParentDepartmentID,
+		LeaderUserID:       dep.LeaderUserID,
+		ChatID:             dep.ChatID,
+		UnitIDs:            dep.UnitIDs,
+	}
+	current.Order, _ = strconv.Atoi(dep.Order)
+	if dep.Status != nil && dep.Status.IsDeleted {
+		return groupDelete(ctx, token, &lm.ContactDepMsg{Header: msg.Header, Event: &lm.ContactDepMsgEvt{Object: current}})
+	}
+	old := *current
+	refetched := &lm.ContactDepMsg{Header: msg.Header, Event: &lm.ContactDepMsgEvt{Object: current, OldObject: &old}}
+	inScope, err := depInScope(current.OpenDepartmentID, larkDepLookup(ctx, dep))
+	if err != nil {
+		return err
+	}
+	if !inScope {
+		logger.Infof("department %v is out of scope, skip it", current.OpenDepartmentID)
+		return nil
+	}
+	return groupUpdate(ctx, token, refetched)
+}
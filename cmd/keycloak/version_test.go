@@ -0,0 +1,81 @@
+package keycloak
+
+import (
+	"context"
+	"io/ioutil"
+	"keycloak-lark-adapter/internal/config"
+	"keycloak-lark-adapter/internal/http"
+	log "keycloak-lark-adapter/internal/logger"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	http2 "net/http"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stubTransport answers the requests of the lark and keycloak APIs by method and path and records them
+type stubTransport struct {
+	responses map[string]string
+	requests  []string
+}
+
+func (s *stubTransport) RoundTrip(req *http2.Request) (*http2.Response, error) {
+	route := req.Method + " " + req.URL.Path
+	s.requests = append(s.requests, route)
+	code, body := http2.StatusNotFound, "{}"
+	if resp, ok := s.responses[route]; ok {
+		code, body = http2.StatusOK, resp
+	}
+	return &http2.Response{
+		StatusCode: code,
+		Header:     http2.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestStaleUserEventNotFound(t *testing.T) {
+	log.Logger = logrus.New()
+	config.Host, config.Realm = "http://keycloak.test", "test"
+	config.StaleEventPolicy = staleEventRefetch
+	config.UserMatchOrder = []string{matcherOpenId}
+	config.OffboardDeleteNever, config.OffboardDeleteAfter = false, 0
+	defer func() { config.StaleEventPolicy, config.UserMatchOrder = staleEventSkip, nil }()
+	transport := http.Client.GetClient().Transport
+	defer http.Client.SetTransport(transport)
+
+	msg := &lm.ContactUserMsg{
+		Header: &lm.ContactMsgHeader{EventID: "ev-1", EventType: eventTypeUserUpdate},
+		Event:  &lm.ContactUserMsgEvt{Object: &lm.UserObject{OpenID: "ou-alice", Email: "alice@example.com"}},
+	}
+	users := `[{"id": "kc-alice", "username": "alice", "attributes": {"lark_open_id": ["ou-alice"]}}]`
+	tests := []struct {
+		name       string
+		users      string
+		wantDelete bool
+	}{
+		{name: "deleted in lark", users: users, wantDelete: true},
+		{name: "not in keycloak", users: "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubTransport{responses: map[string]string{
+				"POST /open-apis/auth/v3/app_access_token/internal/": `{"app_access_token": "t"}`,
+				"GET /auth/admin/realms/test/users":                  tt.users,
+				"DELETE /auth/admin/realms/test/users/kc-alice":      "",
+			}}
+			http.Client.SetTransport(stub)
+			if err := staleUserEvent(context.Background(), "token", msg); err != nil {
+				t.Fatalf("staleUserEvent() error = %v", err)
+			}
+			var deleted bool
+			for _, route := range stub.requests {
+				deleted = deleted || route == "DELETE /auth/admin/realms/test/users/kc-alice"
+			}
+			if deleted != tt.wantDelete {
+				t.Errorf("staleUserEvent() deleted = %v, want %v, requests: %v", deleted, tt.wantDelete, stub.requests)
+			}
+		})
+	}
+}
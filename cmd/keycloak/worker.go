@@ -0,0 +1,91 @@
+package keycloak
+
+import (
+	"hash/fnv"
+	lm "keycloak-lark-adapter/internal/model/lark"
+	"runtime/debug"
+	"sync"
+)
+
+// workerQueueSize is the number of events a worker buffers before the dispatcher blocks
+const workerQueueSize = 100
+
+// workerPool processes events in parallel. Events with the same key are processed by the same worker in the order
+// they are dispatched, barrier events are processed alone after every dispatched event has finished.
+type workerPool struct {
+	queues   []chan func()
+	inflight sync.WaitGroup
+	// lock is held by barrier tasks, nothing is dispatched while one runs
+	lock sync.Mutex
+}
+
+// eventPool is the worker pool of ProcessContactEvent, nil if events are not processed
+var eventPool *workerPool
+
+func newWorkerPool(workers int) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &workerPool{queues: make([]chan func(), workers)}
+	for i := range p.queues {
+		queue := make(chan func(), workerQueueSize)
+		p.queues[i] = queue
+		go func() {
+			for task := range queue {
+				runTask(task)
+			}
+		}()
+	}
+	return p
+}
+
+// dispatch queues the task on the worker of the key
+func (p *workerPool) dispatch(key string, task func()) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.inflight.Add(1)
+	eventQueueDepth.Add(1)
+	p.queues[h.Sum32()%uint32(len(p.queues))] <- func() {
+		defer p.inflight.Done()
+		defer eventQueueDepth.Add(-1)
+		task()
+	}
+}
+
+// barrier waits for the dispatched tasks and runs the task in the calling goroutine, events are not dispatched
+// until it returns
+func (p *workerPool) barrier(task func()) {
+	eventQueueDepth.Add(1)
+	defer eventQueueDepth.Add(-1)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.inflight.Wait()
+	runTask(task)
+}
+
+// runTask runs the task and recovers from its panic, a panicking event must not stop its worker
+func runTask(task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("event task panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	task()
+}
+
+// isBarrierDepEvent reports whether the department event changes the group tree: creating, deleting, renaming or
+// moving a department changes the paths the user events depend on
+func isBarrierDepEvent(msg *lm.ContactDepMsg) bool {
+	if msg.Header.EventType != eventTypeDepartmentUpdate {
+		return true
+	}
+	depObj, depOldObj := msg.Event.Object, msg.Event.OldObject
+	if depOldObj == nil {
+		return true
+	}
+	return (depOldObj.Name != "" && depOldObj.Name != depObj.Name) ||
+		(depOldObj.ParentDepartmentID != "" && depOldObj.ParentDepartmentID != depObj.ParentDepartmentID) ||
+		depObj.Status.IsDeleted
+}
@@ -1,6 +1,7 @@
 package lark
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,29 +10,28 @@ import (
 	log "keycloak-lark-adapter/internal/logger"
 	"keycloak-lark-adapter/internal/model/lark"
 	"keycloak-lark-adapter/pkg/utils"
+	http2 "net/http"
 
 	"github.com/bitly/go-simplejson"
-	"github.com/sirupsen/logrus"
 )
 
 const (
 	RootDepartmentId = "0"
 )
 
-var (
-	logger *logrus.Logger
-)
+// ErrUserNotFound is returned by GetUser if the user does not exist in lark
+var ErrUserNotFound = errors.New("user not found in lark")
 
-func Init() {
-	logger = log.Logger
-}
+func getAppToken(ctx context.Context) (token string, err error) {
+	logger := log.FromContext(ctx)
+	defer func() { http.CountTokenRefresh(http.ServiceLark, err == nil) }()
 
-func getAppToken() (token string, err error) {
 	m := make(map[string]string)
 	m["app_id"] = config.AppId
 	m["app_secret"] = config.AppSecret
 
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetBody(m).
 		Post("https://open.feishu.cn/open-apis/auth/v3/app_access_token/internal/")
@@ -63,8 +63,8 @@ func getAppToken() (token string, err error) {
 }
 
 // GetFullDepName get full path of current department by department id
-func GetFullDepName(depId string) (depName string, err error) {
-	token, err := getAppToken()
+func GetFullDepName(ctx context.Context, depId string) (depName string, err error) {
+	token, err := getAppToken(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -74,7 +74,7 @@ func GetFullDepName(depId string) (depName string, err error) {
 
 	// 若depId不为0，则递归查找parent department
 	for {
-		depResp, err := GetDepInfo(token, depId)
+		depResp, err := GetDepInfo(ctx, token, depId)
 		if err != nil {
 			return "", err
 		}
@@ -88,11 +88,14 @@ func GetFullDepName(depId string) (depName string, err error) {
 	}
 }
 
-func GetDepInfo(token, depId string) (depResp *lark.DepartmentResponse, err error) {
+func GetDepInfo(ctx context.Context, token, depId string) (depResp *lark.DepartmentResponse, err error) {
+	logger := log.FromContext(ctx)
 	resp, err := http.Client.R().
+		SetContext(ctx).
 		SetHeader("Content-Type", "application/json").
 		SetHeader("Authorization", token).
-		Get("https://open.feishu.cn/open-apis/contact/v3/departments/" + depId)
+		SetPathParams(map[string]string{"department_id": depId}).
+		Get("https://open.feishu.cn/open-apis/contact/v3/departments/{department_id}")
 	if err != nil {
 		logger.Errorf("get department %v info from lark failed, error: %v", depId, err.Error())
 		return nil, err
@@ -112,3 +115,209 @@ func GetDepInfo(token, depId string) (depResp *lark.DepartmentResponse, err erro
 	}
 	return depResp, nil
 }
+
+// GetDepartment get department detail from lark by department id
+func GetDepartment(ctx context.Context, depId string) (dep *lark.DepartmentDetail, err error) {
+	logger := log.FromContext(ctx)
+	token, err := getAppToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	depResp, err := GetDepInfo(ctx, token, depId)
+	if err != nil {
+		return nil, err
+	}
+	if depResp.Data == nil || depResp.Data.Department == nil {
+		errMsg := fmt.Sprintf("get department info by id %v from lark failed, code: %v, msg: %v", depId, depResp.Code, depResp.Msg)
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	return depResp.Data.Department, nil
+}
+
+// ListDepartments get all departments below the root department from lark
+func ListDepartments(ctx context.Context) (deps []*lark.DepartmentDetail, err error) {
+	logger := log.FromContext(ctx)
+	token, err := getAppToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pageToken := ""
+	for {
+		resp, err := http.Client.R().
+			SetContext(ctx).
+			SetHeader("Content-Type", "application/json").
+			SetHeader("Authorization", token).
+			SetQueryParams(map[string]string{
+				"department_id_type": "open_department_id",
+				"fetch_child":        "true",
+				"page_size":          "50",
+				"page_token":         pageToken,
+			}).
+			SetPathParams(map[string]string{"department_id": RootDepartmentId}).
+			Get("https://open.feishu.cn/open-apis/contact/v3/departments/{department_id}/children")
+		if err != nil {
+			logger.Errorf("list departments from lark failed, error: %v", err.Error())
+			return nil, err
+		}
+		if !utils.IsSuccessResponse(resp.StatusCode()) {
+			errMsg := fmt.Sprintf("list departments from lark failed, response code: %v, response bdoy: %v", resp.StatusCode(), string(resp.Body()))
+			logger.Errorf(errMsg)
+			return nil, errors.New(errMsg)
+		}
+
+		listResp := new(lark.DepartmentListResponse)
+		if err = json.Unmarshal(resp.Body(), listResp); err != nil {
+			logger.Errorf("unmarshal department list failed, error: %v", err)
+			return nil, err
+		}
+		if listResp.Code != 0 || listResp.Data == nil {
+			errMsg := fmt.Sprintf("list departments from lark failed, code: %v, msg: %v", listResp.Code, listResp.Msg)
+			logger.Errorf(errMsg)
+			return nil, errors.New(errMsg)
+		}
+
+		deps = append(deps, listResp.Data.Items...)
+		if !listResp.Data.HasMore || listResp.Data.PageToken == "" {
+			return deps, nil
+		}
+		pageToken = listResp.Data.PageToken
+	}
+}
+
+// DepartmentPaths builds the full path of every department, the same format as GetFullDepName, keyed by open department id
+func DepartmentPaths(deps []*lark.DepartmentDetail) map[string]string {
+	depMap := make(map[string]*lark.DepartmentDetail, len(deps))
+	for _, dep := range deps {
+		depMap[dep.OpenDepartmentID] = dep
+	}
+
+	paths := make(map[string]string, len(deps))
+	var f func(depId string) string
+	f = func(depId string) string {
+		if path, ok := paths[depId]; ok {
+			return path
+		}
+		dep, ok := depMap[depId]
+		if !ok {
+			return ""
+		}
+		// mark as visited in case lark returns a cyclic parent chain
+		paths[depId] = ""
+		path := f(dep.ParentDepartmentID) + "/" + dep.Name
+		paths[depId] = path
+		return path
+	}
+	for _, dep := range deps {
+		f(dep.OpenDepartmentID)
+	}
+	return paths
+}
+
+// ListUsers get the users of the departments from lark, users belonging to more than one department are returned once
+func ListUsers(ctx context.Context, depIds []string) (users []*lark.UserObject, err error) {
+	logger := log.FromContext(ctx)
+	token, err := getAppToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, depId := range depIds {
+		pageToken := ""
+		for {
+			resp, err := http.Client.R().
+				SetContext(ctx).
+				SetHeader("Content-Type", "application/json").
+				SetHeader("Authorization", token).
+				SetQueryParams(map[string]string{
+					"department_id":      depId,
+					"department_id_type": "open_department_id",
+					"user_id_type":       "open_id",
+					"page_size":          "50",
+					"page_token":         pageToken,
+				}).
+				Get("https://open.feishu.cn/open-apis/contact/v3/users/find_by_department")
+			if err != nil {
+				logger.Errorf("list users of department %v from lark failed, error: %v", depId, err.Error())
+				return nil, err
+			}
+			if !utils.IsSuccessResponse(resp.StatusCode()) {
+				errMsg := fmt.Sprintf("list users of department %v from lark failed, response code: %v, response bdoy: %v", depId, resp.StatusCode(), string(resp.Body()))
+				logger.Errorf(errMsg)
+				return nil, errors.New(errMsg)
+			}
+
+			listResp := new(lark.UserListResponse)
+			if err = json.Unmarshal(resp.Body(), listResp); err != nil {
+				logger.Errorf("unmarshal user list failed, error: %v", err)
+				return nil, err
+			}
+			if listResp.Code != 0 || listResp.Data == nil {
+				errMsg := fmt.Sprintf("list users of department %v from lark failed, code: %v, msg: %v", depId, listResp.Code, listResp.Msg)
+				logger.Errorf(errMsg)
+				return nil, errors.New(errMsg)
+			}
+
+			for _, user := range listResp.Data.Items {
+				if seen[user.OpenID] {
+					continue
+				}
+				seen[user.OpenID] = true
+				users = append(users, user)
+			}
+			if !listResp.Data.HasMore || listResp.Data.PageToken == "" {
+				break
+			}
+			pageToken = listResp.Data.PageToken
+		}
+	}
+	return users, nil
+}
+
+// GetUser get user info from lark by open id
+func GetUser(ctx context.Context, openId string) (user *lark.UserObject, err error) {
+	logger := log.FromContext(ctx)
+	token, err := getAppToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Authorization", token).
+		SetQueryParams(map[string]string{
+			"department_id_type": "open_department_id",
+			"user_id_type":       "open_id",
+		}).
+		SetPathParams(map[string]string{"user_id": openId}).
+		Get("https://open.feishu.cn/open-apis/contact/v3/users/{user_id}")
+	if err != nil {
+		logger.Errorf("get user %v from lark failed, error: %v", openId, err.Error())
+		return nil, err
+	}
+	if resp.StatusCode() == http2.StatusNotFound {
+		logger.Infof("user %v does not exist in lark", openId)
+		return nil, ErrUserNotFound
+	}
+	if !utils.IsSuccessResponse(resp.StatusCode()) {
+		errMsg := fmt.Sprintf("get user %v from lark failed, response code: %v, response bdoy: %v", openId, resp.StatusCode(), string(resp.Body()))
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+
+	userResp := new(lark.UserResponse)
+	if err = json.Unmarshal(resp.Body(), userResp); err != nil {
+		logger.Errorf("unmarshal user info failed, error: %v", err)
+		return nil, err
+	}
+	if userResp.Code != 0 || userResp.Data == nil || userResp.Data.User == nil {
+		errMsg := fmt.Sprintf("get user %v from lark failed, code: %v, msg: %v", openId, userResp.Code, userResp.Msg)
+		logger.Errorf(errMsg)
+		return nil, errors.New(errMsg)
+	}
+	return userResp.Data.User, nil
+}
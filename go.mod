@@ -9,6 +9,11 @@ require (
 	github.com/gin-gonic/gin v1.7.2
 	github.com/go-resty/resty/v2 v2.5.0
 	github.com/gorilla/websocket v1.4.2
-	github.com/kr/pretty v0.1.0 // indirect
+	github.com/prometheus/client_golang v1.11.1
 	github.com/sirupsen/logrus v1.8.1
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 )
@@ -3,16 +3,41 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
 	LogLevel string
+	// LogFormat is the format of log lines: text or json, default text
+	LogFormat string
 
 	// Keycloak related config
 	Host         string
 	ClientId     string
 	ClientSecret string
 	Realm        string
+	// IdpAlias is the alias of the lark identity provider in keycloak, users are matched by federated link when set
+	IdpAlias string
+	// IdpUserIdField is the lark user id used as federated user id by the identity provider, default "open_id"
+	IdpUserIdField string
+	// UserMatchOrder defines the matchers used to find the keycloak user of a lark user, tried in order
+	UserMatchOrder []string
+	// EmailChangeUsernamePolicy "update" changes the username along with the email if the username was the old email,
+	// "keep" never changes the username. Default "update"
+	EmailChangeUsernamePolicy string
+	// UsernameStrategy builds the username of new users: email, email_local_part, employee_no, user_id or template,
+	// default email
+	UsernameStrategy string
+	// UsernameTemplate is the go template over the lark user fields of the template strategy
+	UsernameTemplate string
+	// EmailTemplate is the go template over the lark user fields building the email of users without email and
+	// enterprise email, such as "{{.employee_no}}@factory.example.com"
+	EmailTemplate string
+	// RootGroup is the path of the group the groups of first class lark departments are created under, such as "/lark".
+	// Empty creates them as first class groups
+	RootGroup string
 
 	// Lark related config
 	AppId             string
@@ -24,10 +49,98 @@ var (
 	EventSource string
 	// ServerPort default 8080
 	ServerPort string
+	// WebsocketServerEnabled serves healthz, metrics and the sync status on ServerPort in websocket mode as well,
+	// default false. In http mode the server always runs, it receives the events
+	WebsocketServerEnabled bool
+
+	// Periodic reconciliation related config, disabled if neither SyncInterval nor SyncCron is set
+	SyncInterval time.Duration
+	SyncCron     string
+	// SyncJitter delays every run by a random duration up to SyncJitter
+	SyncJitter time.Duration
+	// SyncMaxChanges aborts a scheduled run whose plan has more changes, 0 means no limit
+	SyncMaxChanges int
+	// SyncMaxDeletions refuses to apply a plan deleting, archiving or offboarding more groups and users, either a
+	// count or with SyncMaxDeletionsPercent a percentage of the groups and users bound to lark. Default 10%, -1 means
+	// no limit
+	SyncMaxDeletions        int
+	SyncMaxDeletionsPercent bool
+
+	// StateFile persists state such as scheduled deletions, default "state.json". Relative paths are resolved against
+	// the working directory, in containers it has to be on a volume to survive restarts
+	StateFile string
+
+	// Offboarding related config for frozen, resigned and deleted lark users
+	// OffboardActions any of disable, remove_groups, move_alumni and record_reason, default disable,record_reason
+	OffboardActions []string
+	// OffboardAlumniGroup is the path of the group resigned users are moved to by move_alumni
+	OffboardAlumniGroup string
+	// OffboardDeleteNever keeps resigned and deleted users forever, otherwise they are deleted after OffboardDeleteAfter.
+	// Unset OFFBOARD_DELETE_AFTER is never, "0" deletes immediately
+	OffboardDeleteNever bool
+	OffboardDeleteAfter time.Duration
+
+	// DepartmentDeletePolicy is applied to the group of a deleted lark department: delete, archive or refuse, default delete
+	DepartmentDeletePolicy string
+	// DepartmentArchiveGroup is the path of the group archived groups are moved under, default "/archived"
+	DepartmentArchiveGroup string
+	// DepartmentArchiveMoveMembers moves the members of an archived group to its parent group
+	DepartmentArchiveMoveMembers bool
+
+	// DepartmentLeaderRole is the realm role granted to department leaders, no role is granted if empty
+	DepartmentLeaderRole string
+	// LeaderAttributeFormat is the value of the leader and manager attributes: email or id (the keycloak user id), default email
+	LeaderAttributeFormat string
+
+	// AttributeMappings json array of mappings from lark user fields to keycloak user fields, see the README
+	AttributeMappings string
+
+	// NameStrategy splits lark names into firstName and lastName: parenthesis, en_name, cjk or regex, default parenthesis
+	NameStrategy string
+	// NameRegex is the regular expression of the regex strategy, with the named groups given_name and family_name
+	NameRegex string
+
+	// RoleRules json array of rules granting realm and client roles to lark users, see the README
+	RoleRules string
+
+	// EventWorkers is the number of events processed in parallel, default 1
+	EventWorkers int
+
+	// TraceExporter exports the spans of events and API calls: none, otlp, stdout or file, default none
+	TraceExporter string
+	// TraceOtlpEndpoint is the OTLP/HTTP traces endpoint of the collector, default "http://localhost:4318/v1/traces"
+	TraceOtlpEndpoint string
+	// TraceFile is the file the file exporter appends spans to, default "traces.json"
+	TraceFile string
+
+	// StaleEventPolicy handles events older than the last applied event of the same user or department: skip or
+	// refetch, which applies the current state in lark instead. Default skip
+	StaleEventPolicy string
+
+	// Scope filters, an empty include list includes everything and excludes win over includes.
+	// Departments are lark department ids or paths such as "/Dev/QA", both cover the whole subtree.
+	DepartmentInclude []string
+	DepartmentExclude []string
+	// UserIncludeIds and UserExcludeIds match the open id, union id, user id, employee no or email of lark users
+	UserIncludeEmployeeTypes []int
+	UserExcludeEmployeeTypes []int
+	UserIncludeEmailDomains  []string
+	UserExcludeEmailDomains  []string
+	UserIncludeIds           []string
+	UserExcludeIds           []string
+	// OutOfScopeAction is applied to the keycloak user of a lark user out of scope: ignore or offboard, default ignore
+	OutOfScopeAction string
 )
 
 func Init() {
 	LogLevel = os.Getenv("LOG_LEVEL")
+	LogFormat = strings.ToLower(os.Getenv("LOG_FORMAT"))
+	if len(LogFormat) == 0 {
+		LogFormat = "text"
+	}
+	if LogFormat != "text" && LogFormat != "json" {
+		log.Fatalf("unsupported LOG_FORMAT %v, should be text or json", LogFormat)
+	}
 
 	Host = os.Getenv("KEYCLOAK_HOST")
 	if len(Host) == 0 {
@@ -49,6 +162,37 @@ func Init() {
 		log.Fatalf("cannot get param KEYCLOAK_REALM from env")
 	}
 
+	IdpAlias = os.Getenv("KEYCLOAK_IDP_ALIAS")
+
+	IdpUserIdField = os.Getenv("KEYCLOAK_IDP_USER_ID_FIELD")
+	if len(IdpUserIdField) == 0 {
+		IdpUserIdField = "open_id"
+	}
+
+	if root := strings.Trim(os.Getenv("KEYCLOAK_ROOT_GROUP"), "/ "); len(root) > 0 {
+		RootGroup = "/" + root
+	}
+
+	UserMatchOrder = splitList(os.Getenv("USER_MATCH_ORDER"))
+	if len(UserMatchOrder) == 0 {
+		UserMatchOrder = []string{"federated_link", "open_id", "email", "username"}
+	}
+
+	UsernameStrategy = strings.ToLower(os.Getenv("USERNAME_STRATEGY"))
+	if len(UsernameStrategy) == 0 {
+		UsernameStrategy = "email"
+	}
+	UsernameTemplate = os.Getenv("USERNAME_TEMPLATE")
+	EmailTemplate = os.Getenv("EMAIL_TEMPLATE")
+
+	EmailChangeUsernamePolicy = strings.ToLower(os.Getenv("EMAIL_CHANGE_USERNAME_POLICY"))
+	if len(EmailChangeUsernamePolicy) == 0 {
+		EmailChangeUsernamePolicy = "update"
+	}
+	if EmailChangeUsernamePolicy != "update" && EmailChangeUsernamePolicy != "keep" {
+		log.Fatalf("unsupported EMAIL_CHANGE_USERNAME_POLICY %v, should be update or keep", EmailChangeUsernamePolicy)
+	}
+
 	AppId = os.Getenv("LARK_APP_ID")
 	if len(AppId) == 0 {
 		log.Fatalf("cannot get param LARK_APP_ID from env")
@@ -75,5 +219,175 @@ func Init() {
 	if len(ServerPort) == 0 {
 		ServerPort = "8080"
 	}
+	WebsocketServerEnabled = strings.ToLower(os.Getenv("WEBSOCKET_SERVER_ENABLED")) == "true"
+
+	SyncInterval = parseDuration("SYNC_INTERVAL")
+	SyncCron = os.Getenv("SYNC_CRON")
+	if SyncInterval > 0 && len(SyncCron) > 0 {
+		log.Fatalf("SYNC_INTERVAL and SYNC_CRON cannot be set at the same time")
+	}
+	SyncJitter = parseDuration("SYNC_JITTER")
+	SyncMaxChanges = parseInt("SYNC_MAX_CHANGES")
+	SyncMaxDeletions, SyncMaxDeletionsPercent = parseLimit("SYNC_MAX_DELETIONS", "10%")
+
+	StateFile = os.Getenv("STATE_FILE")
+	if len(StateFile) == 0 {
+		StateFile = "state.json"
+	}
+
+	OffboardActions = splitList(os.Getenv("OFFBOARD_ACTIONS"))
+	if len(OffboardActions) == 0 {
+		OffboardActions = []string{"disable", "record_reason"}
+	}
+	OffboardAlumniGroup = os.Getenv("OFFBOARD_ALUMNI_GROUP")
+	// "never" keeps users forever, empty deletes immediately
+	// 未配置时从不删除用户，升级后不会开始删除账号
+	if deleteAfter := strings.ToLower(os.Getenv("OFFBOARD_DELETE_AFTER")); deleteAfter == "" || deleteAfter == "never" {
+		OffboardDeleteNever = true
+	} else {
+		OffboardDeleteAfter = parseDuration("OFFBOARD_DELETE_AFTER")
+	}
+
+	DepartmentDeletePolicy = strings.ToLower(os.Getenv("DEPARTMENT_DELETE_POLICY"))
+	if len(DepartmentDeletePolicy) == 0 {
+		DepartmentDeletePolicy = "delete"
+	}
+	if DepartmentDeletePolicy != "delete" && DepartmentDeletePolicy != "archive" && DepartmentDeletePolicy != "refuse" {
+		log.Fatalf("unsupported DEPARTMENT_DELETE_POLICY %v, should be delete, archive or refuse", DepartmentDeletePolicy)
+	}
+	DepartmentArchiveGroup = os.Getenv("DEPARTMENT_ARCHIVE_GROUP")
+	if len(DepartmentArchiveGroup) == 0 {
+		DepartmentArchiveGroup = "/archived"
+	}
+	DepartmentArchiveMoveMembers = strings.ToLower(os.Getenv("DEPARTMENT_ARCHIVE_MOVE_MEMBERS")) == "true"
 
+	AttributeMappings = os.Getenv("ATTRIBUTE_MAPPINGS")
+	NameStrategy = strings.ToLower(os.Getenv("NAME_STRATEGY"))
+	if len(NameStrategy) == 0 {
+		NameStrategy = "parenthesis"
+	}
+	NameRegex = os.Getenv("NAME_REGEX")
+	RoleRules = os.Getenv("ROLE_RULES")
+
+	DepartmentInclude = splitList(os.Getenv("DEPARTMENT_INCLUDE"))
+	DepartmentExclude = splitList(os.Getenv("DEPARTMENT_EXCLUDE"))
+	UserIncludeEmployeeTypes = parseIntList("USER_INCLUDE_EMPLOYEE_TYPES")
+	UserExcludeEmployeeTypes = parseIntList("USER_EXCLUDE_EMPLOYEE_TYPES")
+	UserIncludeEmailDomains = splitList(strings.ToLower(os.Getenv("USER_INCLUDE_EMAIL_DOMAINS")))
+	UserExcludeEmailDomains = splitList(strings.ToLower(os.Getenv("USER_EXCLUDE_EMAIL_DOMAINS")))
+	UserIncludeIds = splitList(os.Getenv("USER_INCLUDE_IDS"))
+	UserExcludeIds = splitList(os.Getenv("USER_EXCLUDE_IDS"))
+	EventWorkers = parseInt("EVENT_WORKERS")
+	if EventWorkers == 0 {
+		EventWorkers = 1
+	}
+
+	TraceExporter = strings.ToLower(os.Getenv("TRACE_EXPORTER"))
+	if len(TraceExporter) == 0 {
+		TraceExporter = "none"
+	}
+	if TraceExporter != "none" && TraceExporter != "otlp" && TraceExporter != "stdout" && TraceExporter != "file" {
+		log.Fatalf("unsupported TRACE_EXPORTER %v, should be none, otlp, stdout or file", TraceExporter)
+	}
+	TraceOtlpEndpoint = os.Getenv("TRACE_OTLP_ENDPOINT")
+	if len(TraceOtlpEndpoint) == 0 {
+		TraceOtlpEndpoint = "http://localhost:4318/v1/traces"
+	}
+	TraceFile = os.Getenv("TRACE_FILE")
+	if len(TraceFile) == 0 {
+		TraceFile = "traces.json"
+	}
+
+	StaleEventPolicy = strings.ToLower(os.Getenv("STALE_EVENT_POLICY"))
+	if len(StaleEventPolicy) == 0 {
+		StaleEventPolicy = "skip"
+	}
+
+	OutOfScopeAction = strings.ToLower(os.Getenv("OUT_OF_SCOPE_ACTION"))
+	if len(OutOfScopeAction) == 0 {
+		OutOfScopeAction = "ignore"
+	}
+	if OutOfScopeAction != "ignore" && OutOfScopeAction != "offboard" {
+		log.Fatalf("unsupported OUT_OF_SCOPE_ACTION %v, should be ignore or offboard", OutOfScopeAction)
+	}
+
+	DepartmentLeaderRole = os.Getenv("DEPARTMENT_LEADER_ROLE")
+	LeaderAttributeFormat = strings.ToLower(os.Getenv("LEADER_ATTRIBUTE_FORMAT"))
+	if len(LeaderAttributeFormat) == 0 {
+		LeaderAttributeFormat = "email"
+	}
+	if LeaderAttributeFormat != "email" && LeaderAttributeFormat != "id" {
+		log.Fatalf("unsupported LEADER_ATTRIBUTE_FORMAT %v, should be email or id", LeaderAttributeFormat)
+	}
+}
+
+// parseDuration parses a duration env such as "30m", an empty env is 0
+func parseDuration(key string) time.Duration {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Fatalf("invalid param %v %v, should be a duration such as 30m", key, value)
+	}
+	return d
+}
+
+// parseLimit parses a count such as "50" or a percentage such as "10%", "unlimited" is -1
+func parseLimit(key, defaultValue string) (limit int, percent bool) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if len(value) == 0 {
+		value = defaultValue
+	}
+	if strings.ToLower(value) == "unlimited" {
+		return -1, false
+	}
+	if strings.HasSuffix(value, "%") {
+		percent = true
+		value = strings.TrimSuffix(value, "%")
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 || (percent && limit > 100) {
+		log.Fatalf("invalid param %v %v, should be a count, a percentage such as 10%% or unlimited", key, value)
+	}
+	return limit, percent
+}
+
+// parseInt parses a non-negative integer env, an empty env is 0
+func parseInt(key string) int {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("invalid param %v %v, should be a non-negative integer", key, value)
+	}
+	return n
+}
+
+// parseIntList parses a comma separated list of integers such as "1,2"
+func parseIntList(key string) []int {
+	var items []int
+	for _, item := range splitList(os.Getenv(key)) {
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			log.Fatalf("invalid param %v %v, should be a comma separated list of integers", key, os.Getenv(key))
+		}
+		items = append(items, n)
+	}
+	return items
+}
+
+// splitList splits a comma separated env value, empty items are dropped
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
 }
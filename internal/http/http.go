@@ -1,11 +1,125 @@
 package http
 
-import "github.com/go-resty/resty/v2"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"keycloak-lark-adapter/internal/config"
+	"keycloak-lark-adapter/pkg/trace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	ServiceLark     = "lark"
+	ServiceKeycloak = "keycloak"
+)
 
 var (
 	Client *resty.Client
+
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_requests_total",
+		Help: "Requests to the lark and keycloak APIs, by service, method, path and status code.",
+	}, []string{"service", "method", "path", "code"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "api_request_duration_seconds",
+		Help: "Latency of the requests to the lark and keycloak APIs, by service, method and path.",
+	}, []string{"service", "method", "path"})
+	tokenRefreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "token_refreshes_total",
+		Help: "Access tokens fetched from lark and keycloak, by service and result.",
+	}, []string{"service", "result"})
 )
 
 func init() {
 	Client = resty.New()
+	// every request is a child span of the span carried by the context of the request, such as the span of an event.
+	// The hooks run before resty fills in the path params, the url is still the route template such as
+	// "/users/{id}/groups" which labels the metrics and spans of the request.
+	Client.OnBeforeRequest(func(c *resty.Client, req *resty.Request) error {
+		path := requestRoute(req.URL)
+		ctx := context.WithValue(req.Context(), routeKey{}, path)
+		ctx, span := trace.Start(ctx, req.Method+" "+path, oteltrace.SpanKindClient)
+		span.SetAttributes(
+			attribute.String("service", requestService(req.URL)),
+			attribute.String("http.method", req.Method),
+			attribute.String("http.route", path),
+		)
+		req.SetContext(ctx)
+		return nil
+	})
+	Client.OnAfterResponse(func(c *resty.Client, resp *resty.Response) error {
+		observeRequest(resp.Request, strconv.Itoa(resp.StatusCode()), resp.Time())
+		span := oteltrace.SpanFromContext(resp.Request.Context())
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode()))
+		var err error
+		if !resp.IsSuccess() {
+			err = fmt.Errorf("response code %v", resp.StatusCode())
+		}
+		trace.End(span, err)
+		return nil
+	})
+	Client.OnError(func(req *resty.Request, err error) {
+		// ending a span twice does nothing, the span of an error with a response has ended already
+		trace.End(oteltrace.SpanFromContext(req.Context()), err)
+		// errors with a response have been observed after the response already
+		var respErr *resty.ResponseError
+		if errors.As(err, &respErr) {
+			return
+		}
+		observeRequest(req, "error", time.Since(req.Time))
+	})
+}
+
+// CountTokenRefresh counts an access token fetched from the service
+func CountTokenRefresh(service string, ok bool) {
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	tokenRefreshesTotal.WithLabelValues(service, result).Inc()
+}
+
+func observeRequest(req *resty.Request, code string, latency time.Duration) {
+	if req == nil {
+		return
+	}
+	service := requestService(req.URL)
+	path, ok := req.Context().Value(routeKey{}).(string)
+	if !ok {
+		path = "unknown"
+	}
+	requestsTotal.WithLabelValues(service, req.Method, path, code).Inc()
+	requestDuration.WithLabelValues(service, req.Method, path).Observe(latency.Seconds())
+}
+
+// requestService returns the service the url belongs to, ServiceKeycloak or ServiceLark
+func requestService(rawURL string) string {
+	if config.Host != "" && strings.HasPrefix(rawURL, config.Host) {
+		return ServiceKeycloak
+	}
+	return ServiceLark
+}
+
+// routeKey is the context key of the route template of a request
+type routeKey struct{}
+
+// requestRoute returns the path of the route template of the request, ids are passed as path params such as {id}
+// so that the number of routes stays bounded
+func requestRoute(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "unknown"
+	}
+	return u.Path
 }
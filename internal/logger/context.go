@@ -0,0 +1,25 @@
+package log
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+type entryKey struct{}
+
+// WithFields returns a copy of ctx whose log entry carries the fields in addition to those of ctx, the lines logged
+// with FromContext carry them.
+//
+//	ctx = log.WithFields(ctx, logrus.Fields{"event_id": id})
+func WithFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return context.WithValue(ctx, entryKey{}, FromContext(ctx).WithFields(fields))
+}
+
+// FromContext returns the log entry carried by ctx, an entry of Logger without fields if there is none
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(entryKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(Logger)
+}
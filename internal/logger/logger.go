@@ -2,6 +2,7 @@ package log
 
 import (
 	"keycloak-lark-adapter/internal/config"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -14,6 +15,8 @@ const (
 	logWarnLevel  = "warn"
 	logFatalLevel = "fatal"
 	logPanicLevel = "panic"
+
+	logJSONFormat = "json"
 )
 
 var (
@@ -47,8 +50,14 @@ func Init() {
 	Logger.SetLevel(loggerLevel)
 	Logger.SetReportCaller(true)
 
-	customFormatter := new(logrus.TextFormatter)
-	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
-	Logger.SetFormatter(customFormatter)
-	customFormatter.FullTimestamp = true
+	if config.LogFormat == logJSONFormat {
+		jsonFormatter := new(logrus.JSONFormatter)
+		jsonFormatter.TimestampFormat = time.RFC3339Nano
+		Logger.SetFormatter(jsonFormatter)
+	} else {
+		customFormatter := new(logrus.TextFormatter)
+		customFormatter.TimestampFormat = "2006-01-02 15:04:05"
+		Logger.SetFormatter(customFormatter)
+		customFormatter.FullTimestamp = true
+	}
 }
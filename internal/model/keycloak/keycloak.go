@@ -24,6 +24,47 @@ func (u *User) String() string {
 		u.Id, u.Username, *u.Enabled, u.Attributes, u.Email, u.EmailVerified, u.FirstName, u.LastName)
 }
 
+// GetAttribute returns the first value of the user attribute key, or "" if it is not set
+func (u *User) GetAttribute(key string) string {
+	return AttributeValue(u.Attributes, key)
+}
+
+// FederatedIdentity defines the link between a keycloak user and an identity provider account
+type FederatedIdentity struct {
+	IdentityProvider string `json:"identityProvider"`
+	UserID           string `json:"userId"`
+	UserName         string `json:"userName"`
+}
+
+// Role defines a realm role
+type Role struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Composite   bool   `json:"composite"`
+	ClientRole  bool   `json:"clientRole"`
+	ContainerID string `json:"containerId,omitempty"`
+}
+
+// RoleMappings defines the roles granted to a user directly
+type RoleMappings struct {
+	RealmMappings  []*Role                    `json:"realmMappings,omitempty"`
+	ClientMappings map[string]*ClientMappings `json:"clientMappings,omitempty"`
+}
+
+// ClientMappings defines the roles of a client granted to a user, keyed by client id in RoleMappings
+type ClientMappings struct {
+	ID       string  `json:"id"`
+	Client   string  `json:"client"`
+	Mappings []*Role `json:"mappings"`
+}
+
+// Client defines a keycloak client, ID is the internal id and ClientID the name used in tokens
+type Client struct {
+	ID       string `json:"id"`
+	ClientID string `json:"clientId"`
+}
+
 type GroupAssignment struct {
 	GroupID string `json:"groupId"`
 	Realm   string `json:"realm"`
@@ -40,3 +81,53 @@ type GroupInfo struct {
 	SubGroups   []*GroupInfo           `json:"subGroups,omitempty"`
 	ID          string                 `json:"id,omitempty"`
 }
+
+// GetAttribute returns the first value of the group attribute key, or "" if it is not set
+func (g *GroupInfo) GetAttribute(key string) string {
+	return AttributeValue(g.Attributes, key)
+}
+
+// SetAttribute replaces the values of the group attribute key with value
+func (g *GroupInfo) SetAttribute(key, value string) {
+	if g.Attributes == nil {
+		g.Attributes = map[string]interface{}{}
+	}
+	g.Attributes[key] = []string{value}
+}
+
+// AttributeValue returns the first value of the attribute key. Keycloak returns attributes as string arrays,
+// while attributes set locally may be plain strings
+func AttributeValue(attrs map[string]interface{}, key string) string {
+	switch v := attrs[key].(type) {
+	case string:
+		return v
+	case []string:
+		if len(v) > 0 {
+			return v[0]
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			if s, ok := v[0].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// AttributeValues returns all values of the attribute key
+func AttributeValues(attrs map[string]interface{}, key string) (values []string) {
+	switch v := attrs[key].(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,80 @@
+package lark
+
+import (
+	"encoding/json"
+	"fmt"
+	"keycloak-lark-adapter/internal/store"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// sources of lark events
+	SourceHTTP      = "http"
+	SourceWebsocket = "websocket"
+
+	// reasons of dead-lettering an event
+	DeadLetterUnparsable = "unparsable"
+	DeadLetterInvalid    = "invalid"
+	DeadLetterFailed     = "failed"
+
+	// BucketDeadLetters keeps the events which were not processed, see DeadLetter
+	BucketDeadLetters = "dead_letters"
+	// maxDeadLetters bounds the dead letters kept in the state file, the oldest are removed first
+	maxDeadLetters = 1000
+)
+
+var (
+	EventsReceivedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lark_events_received_total",
+		Help: "Lark events received, by source and event type.",
+	}, []string{"source", "type"})
+	EventsDeadLetteredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lark_events_dead_lettered_total",
+		Help: "Lark events not processed and kept as dead letters, by reason.",
+	}, []string{"reason"})
+
+	deadLetterSeq uint64
+)
+
+// DeadLetterEntry is an event which was not processed, kept in the state file for inspection and replay by hand
+type DeadLetterEntry struct {
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+	Time   string `json:"time"`
+	// Event is the payload as received, it is not valid JSON if the event is unparsable
+	Event string `json:"event"`
+}
+
+// DeadLetter records the event in BucketDeadLetters and counts it by reason. Keys sort by the time the event was
+// dead-lettered, only the last maxDeadLetters are kept.
+func DeadLetter(reason string, event []byte, cause error) error {
+	EventsDeadLetteredTotal.WithLabelValues(reason).Inc()
+
+	now := time.Now()
+	entry := &DeadLetterEntry{Reason: reason, Time: now.UTC().Format(time.RFC3339Nano), Event: string(event)}
+	if cause != nil {
+		entry.Error = cause.Error()
+	}
+	key := fmt.Sprintf("%020d-%06d", now.UnixNano(), atomic.AddUint64(&deadLetterSeq, 1)%1000000)
+	if err := store.Put(BucketDeadLetters, key, entry); err != nil {
+		return err
+	}
+
+	entries := store.List(BucketDeadLetters)
+	if len(entries) <= maxDeadLetters {
+		return nil
+	}
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	oldest := keys[len(keys)-maxDeadLetters]
+	_, err := store.Prune(BucketDeadLetters, func(k string, _ json.RawMessage) bool { return k < oldest })
+	return err
+}
@@ -14,6 +14,40 @@ type DepartmentResponseData struct {
 	Department *DepartmentDetail `json:"department"`
 }
 
+type DepartmentListResponse struct {
+	Msg  string                      `json:"msg"`
+	Code int                         `json:"code"`
+	Data *DepartmentListResponseData `json:"data"`
+}
+
+type DepartmentListResponseData struct {
+	HasMore   bool                `json:"has_more"`
+	PageToken string              `json:"page_token"`
+	Items     []*DepartmentDetail `json:"items"`
+}
+
+type UserResponse struct {
+	Msg  string            `json:"msg"`
+	Code int               `json:"code"`
+	Data *UserResponseData `json:"data"`
+}
+
+type UserResponseData struct {
+	User *UserObject `json:"user"`
+}
+
+type UserListResponse struct {
+	Msg  string                `json:"msg"`
+	Code int                   `json:"code"`
+	Data *UserListResponseData `json:"data"`
+}
+
+type UserListResponseData struct {
+	HasMore   bool          `json:"has_more"`
+	PageToken string        `json:"page_token"`
+	Items     []*UserObject `json:"items"`
+}
+
 var (
 	UserChan = make(chan *ContactUserMsg, 10)
 	DepChan  = make(chan *ContactDepMsg, 10)
@@ -87,11 +121,14 @@ type ContactDepMsgEvt struct {
 }
 
 type DepObject struct {
-	OpenDepartmentID   string `json:"open_department_id"`
-	DepartmentID       string `json:"department_id"`
-	Name               string `json:"name"`
-	Order              int    `json:"order"`
-	ParentDepartmentID string `json:"parent_department_id"`
+	OpenDepartmentID   string   `json:"open_department_id"`
+	DepartmentID       string   `json:"department_id"`
+	Name               string   `json:"name"`
+	Order              int      `json:"order"`
+	ParentDepartmentID string   `json:"parent_department_id"`
+	LeaderUserID       string   `json:"leader_user_id"`
+	ChatID             string   `json:"chat_id"`
+	UnitIDs            []string `json:"unit_ids"`
 	Status             struct {
 		IsDeleted bool `json:"is_deleted"`
 	} `json:"status"`
@@ -103,6 +140,7 @@ type UserObject struct {
 	Gender        int          `json:"gender"`
 	City          string       `json:"city"`
 	OpenID        string       `json:"open_id"`
+	UnionID       string       `json:"union_id"`
 	Mobile        string       `json:"mobile"`
 	EmployeeNo    string       `json:"employee_no"`
 	Avatar        *UserAvatar  `json:"avatar"`
@@ -112,10 +150,13 @@ type UserObject struct {
 	UserID        string       `json:"user_id"`
 	Name          string       `json:"name"`
 	EnName        string       `json:"en_name"`
+	JobTitle      string       `json:"job_title"`
 	Orders        []*UserOrder `json:"orders"`
 	LeaderUserID  string       `json:"leader_user_id"`
 	Email         string       `json:"email"`
-	Status        *UserStatus  `json:"status"`
+	// EnterpriseEmail is the address of the lark mailbox, used if Email is empty
+	EnterpriseEmail string      `json:"enterprise_email"`
+	Status          *UserStatus `json:"status"`
 }
 
 type UserAvatar struct {
@@ -129,6 +170,7 @@ type UserOrder struct {
 	UserOrder       int    `json:"user_order"`
 	DepartmentID    string `json:"department_id"`
 	DepartmentOrder int    `json:"department_order"`
+	IsPrimaryDept   bool   `json:"is_primary_dept"`
 }
 type UserStatus struct {
 	IsActivated bool `json:"is_activated"`
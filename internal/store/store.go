@@ -0,0 +1,183 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"keycloak-lark-adapter/internal/config"
+	log "keycloak-lark-adapter/internal/logger"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	logger *logrus.Logger
+
+	lock sync.Mutex
+	// bucket -> key -> value
+	data map[string]map[string]json.RawMessage
+	// dirty is set by writes which are not persisted yet, see PutDeferred
+	dirty bool
+)
+
+// Init loads the state persisted in config.StateFile, the file is created on the first write
+func Init() {
+	logger = log.Logger
+	data = map[string]map[string]json.RawMessage{}
+	if !filepath.IsAbs(config.StateFile) {
+		logger.Warnf("state file %v is relative to the working directory, it is lost on restart unless it is on a volume", config.StateFile)
+	}
+
+	buf, err := ioutil.ReadFile(config.StateFile)
+	if os.IsNotExist(err) {
+		logger.Infof("state file %v does not exist, starting with empty state", config.StateFile)
+		return
+	}
+	if err != nil {
+		logger.Fatalf("read state file %v failed, error: %v", config.StateFile, err)
+	}
+	if err = json.Unmarshal(buf, &data); err != nil {
+		logger.Fatalf("unmarshal state file %v failed, error: %v", config.StateFile, err)
+	}
+}
+
+// Get reads the value of key in bucket into v, returns false if the key does not exist
+func Get(bucket, key string, v interface{}) (bool, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	raw, ok := data[bucket][key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Put stores v as the value of key in bucket and persists the state
+func Put(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if data[bucket] == nil {
+		data[bucket] = map[string]json.RawMessage{}
+	}
+	data[bucket][key] = raw
+	return save()
+}
+
+// PutDeferred stores v as the value of key in bucket, the state is persisted by the next Put, Delete or Flush.
+// It is meant for frequent writes which may be lost on a crash, such as the versions of events.
+func PutDeferred(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if data[bucket] == nil {
+		data[bucket] = map[string]json.RawMessage{}
+	}
+	data[bucket][key] = raw
+	dirty = true
+	return nil
+}
+
+// Delete removes key from bucket and persists the state
+func Delete(bucket, key string) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, ok := data[bucket][key]; !ok {
+		return nil
+	}
+	delete(data[bucket], key)
+	return save()
+}
+
+// Prune removes the keys of bucket for which remove returns true and persists the state once
+func Prune(bucket string, remove func(key string, raw json.RawMessage) bool) (int, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	var removed int
+	for key, raw := range data[bucket] {
+		if remove(key, raw) {
+			delete(data[bucket], key)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, save()
+}
+
+// Flush persists the writes of PutDeferred, if any
+func Flush() error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !dirty {
+		return nil
+	}
+	return save()
+}
+
+// StartFlush flushes the deferred writes every interval
+func StartFlush(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := Flush(); err != nil {
+				logger.Errorf("flush state file %v failed, error: %v", config.StateFile, err)
+			}
+		}
+	}()
+}
+
+// List returns a copy of all values in bucket
+func List(bucket string) map[string]json.RawMessage {
+	lock.Lock()
+	defer lock.Unlock()
+
+	items := make(map[string]json.RawMessage, len(data[bucket]))
+	for key, raw := range data[bucket] {
+		items[key] = raw
+	}
+	return items
+}
+
+// save writes the state to a temporary file first, so that a crash never leaves a truncated state file behind
+func save() error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	tmp := config.StateFile + ".tmp"
+	if dir := filepath.Dir(config.StateFile); dir != "." {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			logger.Errorf("create state directory %v failed, error: %v", dir, err)
+			return err
+		}
+	}
+	if err = ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		logger.Errorf("write state file %v failed, error: %v", tmp, err)
+		return err
+	}
+	if err = os.Rename(tmp, config.StateFile); err != nil {
+		logger.Errorf("rename state file %v failed, error: %v", tmp, err)
+		return err
+	}
+	dirty = false
+	return nil
+}
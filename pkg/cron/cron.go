@@ -0,0 +1,146 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed standard 5 field cron expression: minute hour day-of-month month day-of-week
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// cron matches either day field if both are restricted, a field starting with "*" such as "*/2" is not restricted
+	domAny, dowAny bool
+}
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse parses a cron expression, fields support "*", numbers, ranges "a-b", steps "*/n" or "a-b/n" and lists "a,b"
+func Parse(expr string) (*Schedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron expression %q should have %v fields, got %v", expr, len(fields), len(parts))
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, part := range parts {
+		b, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %v", expr, err)
+		}
+		bits[i] = b
+	}
+
+	s := &Schedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: strings.HasPrefix(parts[2], "*"),
+		dowAny: strings.HasPrefix(parts[4], "*"),
+	}
+	// sunday is both 0 and 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseField(value string, f field) (bits uint64, err error) {
+	for _, item := range strings.Split(value, ",") {
+		step := 1
+		if idx := strings.Index(item, "/"); idx >= 0 {
+			step, err = strconv.Atoi(item[idx+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %v field", item[idx+1:], f.name)
+			}
+			item = item[:idx]
+		}
+
+		from, to := f.min, f.max
+		if item != "*" {
+			if idx := strings.Index(item, "-"); idx >= 0 {
+				if from, err = parseNumber(item[:idx], f); err != nil {
+					return 0, err
+				}
+				if to, err = parseNumber(item[idx+1:], f); err != nil {
+					return 0, err
+				}
+			} else {
+				if from, err = parseNumber(item, f); err != nil {
+					return 0, err
+				}
+				to = from
+				if step > 1 {
+					to = f.max
+				}
+			}
+		}
+		if from > to {
+			return 0, fmt.Errorf("invalid range %q in %v field", item, f.name)
+		}
+
+		for i := from; i <= to; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func parseNumber(value string, f field) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("invalid value %q in %v field, should be between %v and %v", value, f.name, f.min, f.max)
+	}
+	return n, nil
+}
+
+// Next returns the first time after t matching the schedule, in the location of t.
+// The zero time is returned if nothing matches within five years, e.g. for "0 0 30 2 *".
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
@@ -0,0 +1,100 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{name: "every minute", expr: "* * * * *"},
+		{name: "numbers", expr: "30 2 1 6 0"},
+		{name: "ranges and steps", expr: "0-30/10 9-17 * * 1-5"},
+		{name: "lists", expr: "0,15,30,45 * * * *"},
+		{name: "sunday as 7", expr: "0 0 * * 7"},
+		{name: "too few fields", expr: "* * * *", wantErr: true},
+		{name: "too many fields", expr: "* * * * * *", wantErr: true},
+		{name: "minute out of range", expr: "60 * * * *", wantErr: true},
+		{name: "day of month zero", expr: "0 0 0 * *", wantErr: true},
+		{name: "reversed range", expr: "0 17-9 * * *", wantErr: true},
+		{name: "zero step", expr: "*/0 * * * *", wantErr: true},
+		{name: "not a number", expr: "a * * * *", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.expr); (err != nil) != tt.wantErr {
+				t.Errorf("Parse(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseField(t *testing.T) {
+	minute := fields[0]
+	tests := []struct {
+		value string
+		want  []int
+	}{
+		{value: "5", want: []int{5}},
+		{value: "10-13", want: []int{10, 11, 12, 13}},
+		{value: "*/15", want: []int{0, 15, 30, 45}},
+		{value: "10-30/10", want: []int{10, 20, 30}},
+		{value: "50/5", want: []int{50, 55}},
+		{value: "1,3-4,58-59/1", want: []int{1, 3, 4, 58, 59}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseField(tt.value, minute)
+			if err != nil {
+				t.Fatalf("parseField(%q) error = %v", tt.value, err)
+			}
+			var want uint64
+			for _, i := range tt.want {
+				want |= 1 << uint(i)
+			}
+			if got != want {
+				t.Errorf("parseField(%q) = %b, want %b", tt.value, got, want)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	// 2024-01-01 is a monday
+	from := time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		name string
+		expr string
+		want time.Time
+	}{
+		{name: "next minute", expr: "* * * * *", want: time.Date(2024, 1, 1, 10, 8, 0, 0, time.UTC)},
+		{name: "step of minutes", expr: "*/15 * * * *", want: time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{name: "daily", expr: "30 2 * * *", want: time.Date(2024, 1, 2, 2, 30, 0, 0, time.UTC)},
+		{name: "weekdays within hours", expr: "0 9-17/4 * * 1-5", want: time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{name: "sunday as 0", expr: "0 0 * * 0", want: time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{name: "sunday as 7", expr: "0 0 * * 7", want: time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{name: "day of month step", expr: "0 0 */10 * *", want: time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)},
+		// a day field starting with "*" is not restricted, both day fields have to match as in standard cron
+		{name: "day of month step and day of week", expr: "0 0 */10 * 5", want: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "day of month and day of week step", expr: "0 0 13 * */2", want: time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{name: "day of week step", expr: "0 0 * * */3", want: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{name: "day of month or day of week", expr: "0 0 15 * 3", want: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{name: "leap day", expr: "0 0 29 2 *", want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{name: "never", expr: "0 0 30 2 *"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.expr, err)
+			}
+			if got := s.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Next() of %q = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// exporters of TRACE_EXPORTER
+const (
+	ExporterNone   = "none"
+	ExporterOtlp   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+const serviceName = "keycloak-lark-adapter"
+
+var (
+	provider *sdktrace.TracerProvider
+	// file is the file of the file exporter, closed on Shutdown
+	file io.Closer
+)
+
+// Init installs the OpenTelemetry tracer provider exporting spans in batches: over OTLP/HTTP to otlpEndpoint, to
+// stdout, or appended to path as JSON. Tracing stays disabled with ExporterNone, spans are not recorded then.
+func Init(exporter, otlpEndpoint, path string) error {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone:
+		return nil
+	case ExporterOtlp:
+		spanExporter, err = newOtlpExporter(otlpEndpoint)
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return err
+		}
+		file = f
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return fmt.Errorf("unsupported trace exporter %v", exporter)
+	}
+	if err != nil {
+		return err
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return nil
+}
+
+// newOtlpExporter returns the exporter sending spans to the OTLP/HTTP traces endpoint, such as
+// http://localhost:4318/v1/traces
+func newOtlpExporter(endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %v", endpoint)
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Path != "" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	return otlptracehttp.New(context.Background(), options...)
+}
+
+// Shutdown exports the pending spans and stops the exporter, the spans ended afterwards are dropped
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	err := provider.Shutdown(ctx)
+	if file != nil {
+		file.Close()
+	}
+	return err
+}
+
+// Start starts a span named name as a child of the span carried by ctx, or of a new trace if there is none, and
+// returns a copy of ctx carrying the new span
+func Start(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	return otel.Tracer(serviceName).Start(ctx, name, trace.WithSpanKind(kind))
+}
+
+// End marks the span as failed with err if it is not nil and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the trace id of the span carried by ctx, "" if tracing is disabled
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
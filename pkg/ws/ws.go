@@ -13,12 +13,20 @@ import (
 	"github.com/cenkalti/backoff"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
 	wsAdapterEndpoint string
 	logger            *logrus.Logger
 	Bot               *LarkGuardBot
+
+	reconnectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_reconnects_total",
+		Help: "Reconnects to the websocket adapter after the connection was lost, by result.",
+	}, []string{"result"})
 )
 
 type LarkGuardBot struct {
@@ -92,9 +100,11 @@ func (l *LarkGuardBot) Run() {
 		err = backoff.Retry(l.setupWebsocketConn, bo)
 		if err != nil {
 			logger.Errorf("failed to reconnect websocket, error: %v", err.Error())
+			reconnectsTotal.WithLabelValues("failure").Inc()
 			return
 		}
 		logger.Infof("websocket reconnect success")
+		reconnectsTotal.WithLabelValues("success").Inc()
 		l.conn.WriteMessage(websocket.TextMessage, buf)
 	}
 }
@@ -110,7 +120,7 @@ func (l *LarkGuardBot) setupWebsocketConn() error {
 }
 
 func (l *LarkGuardBot) HandlePing(data []byte) {
-	logger.Debugf("receive 'pong' msg: %v", string(data))
+	logger.Debugf("receive 'ping' msg")
 
 	err := l.conn.WriteMessage(websocket.PongMessage, data)
 	if err != nil {
@@ -120,29 +130,39 @@ func (l *LarkGuardBot) HandlePing(data []byte) {
 }
 
 func (l *LarkGuardBot) HandlePong(data []byte) {
-	logger.Infof("receive 'pong' msg: %v", string(data))
+	logger.Debugf("receive 'pong' msg")
 }
 
 func (l *LarkGuardBot) HandleBinary(data []byte) {
-	logger.Infof("receive binary msg: %v", string(data))
+	logger.Infof("receive binary msg, %v bytes", len(data))
 }
 
 func (l *LarkGuardBot) HandleClose(data []byte) {
 	logger.Infof("receive close msg: %v", string(data))
 }
 
+// deadLetter keeps the event which cannot be processed, see lm.DeadLetter
+func deadLetter(reason string, data []byte, cause error) {
+	if err := lm.DeadLetter(reason, data, cause); err != nil {
+		logger.Errorf("dead-letter %v event failed, error: %v", reason, err)
+	}
+}
+
 func (l *LarkGuardBot) HandleText(data string) {
-	logger.Infof("receive text msg: %v", data)
+	logger.Debugf("receive text msg, %v bytes", len(data))
 	sj, err := simplejson.NewJson([]byte(data))
 	if err != nil {
 		logger.Errorf("unmarshal text msg failed, error: %v", err.Error())
+		deadLetter(lm.DeadLetterUnparsable, []byte(data), err)
 		return
 	}
 	eventType := sj.Get("header").Get("event_type").MustString()
+	lm.EventsReceivedTotal.WithLabelValues(lm.SourceWebsocket, eventType).Inc()
 	if strings.Contains(eventType, "contact.user") {
 		userMsg := new(lm.ContactUserMsg)
 		if err := json.Unmarshal([]byte(data), userMsg); err != nil {
 			logger.Errorf("failed to parse contact user message, error: %v", err.Error())
+			deadLetter(lm.DeadLetterUnparsable, []byte(data), err)
 			return
 		}
 		lm.UserChan <- userMsg
@@ -155,6 +175,7 @@ func (l *LarkGuardBot) HandleText(data string) {
 		depMsg := new(lm.ContactDepMsg)
 		if err = json.Unmarshal([]byte(data), depMsg); err != nil {
 			logger.Errorf("failed to parse contact department message, error: %v", err.Error())
+			deadLetter(lm.DeadLetterUnparsable, []byte(data), err)
 			return
 		}
 		lm.DepChan <- depMsg